@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/joshkleinlab/tubeguardian/internal/classifier"
 	"github.com/joshkleinlab/tubeguardian/internal/config"
 	"github.com/joshkleinlab/tubeguardian/internal/filter"
 	"github.com/joshkleinlab/tubeguardian/internal/worker"
@@ -14,42 +18,80 @@ import (
 )
 
 func main() {
+	// "tubeguardian train ..." trains the classifier and exits
+	if len(os.Args) > 1 && os.Args[1] == "train" {
+		if err := train(os.Args[2:]); err != nil {
+			log.Fatalf("❌ Training failed: %v", err)
+		}
+		return
+	}
+
+	// Graceful shutdown context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Capture SIGINT / SIGTERM
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigCh
+		log.Println("🛑 Received shutdown signal. Cleaning up...")
+		cancel()
+	}()
+
+	if err := run(ctx, "configs/config.yaml"); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+}
+
+// run moderates the channel configured in configPath until ctx is done
+func run(ctx context.Context, configPath string) error {
 	// Load config.yaml
-	cfg, err := config.LoadConfig("configs/config.yaml")
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
-		log.Fatalf("❌ Failed to load config: %v", err)
+		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// Load banned words
-	matcher, err := filter.LoadKeywords(cfg.BannedWordsFile)
+	// Load banned words and rules
+	matcher, err := filter.Load(cfg)
 	if err != nil {
-		log.Fatalf("❌ Failed to load banned words: %v", err)
+		return fmt.Errorf("failed to load banned words: %w", err)
 	}
 
 	// Initialize YouTube client
-	ctx := context.Background()
-	client, err := youtube.NewClient(ctx, cfg.ChannelID, "configs/credentials.json")
+	client, err := youtube.NewClient(ctx, cfg)
 	if err != nil {
-		log.Fatalf("❌ Failed to create YouTube client: %v", err)
+		return fmt.Errorf("failed to create YouTube client: %w", err)
 	}
 
 	// Setup poller
 	p := worker.NewPoller(client, matcher, cfg)
 
-	// Graceful shutdown context
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// Capture SIGINT / SIGTERM
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	// Load the classifier model; without one, start empty and learn
+	// from reviews
+	if cfg.ClassifierModel != "" {
+		model, err := classifier.Load(cfg.ClassifierModel)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("⚠️  No classifier model at %s yet, it will learn from reviews", cfg.ClassifierModel)
+			model = classifier.New()
+		} else if err != nil {
+			return fmt.Errorf("failed to load classifier model: %w", err)
+		}
+		p.SetClassifier(model)
+	}
 
-	go func() {
-		<-sigCh
-		log.Println("🛑 Received shutdown signal. Cleaning up...")
-		cancel()
-	}()
+	// Start the external classifier
+	if cfg.ExternalClassifier != nil {
+		ext, err := filter.NewExternal(cfg.ExternalClassifier)
+		if err != nil {
+			return fmt.Errorf("failed to set up external classifier: %w", err)
+		}
+		defer ext.Close()
+		p.SetExternal(ext)
+	}
 
 	// Start the poller
 	p.Run(ctx)
+	return nil
 }
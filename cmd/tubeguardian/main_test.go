@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+	"github.com/joshkleinlab/tubeguardian/internal/youtube/youtubetest"
+)
+
+// TestEndToEnd runs TubeGuardian against a fake YouTube Data API
+func TestEndToEnd(t *testing.T) {
+	f := youtubetest.New()
+	f.Subscribe("UCfan")
+	published := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	add := func(c youtube.Comment) {
+		published = published.Add(time.Minute)
+		c.PublishedAt = published
+		f.Add(c)
+	}
+
+	add(youtube.Comment{ID: "clean", VideoID: "vid1", Text: "Great video, thanks!"})
+	add(youtube.Comment{ID: "spam", VideoID: "vid1", Text: "buy cheap followers"})
+	add(youtube.Comment{ID: "thread", VideoID: "vid2", Text: "What camera is that?"})
+	add(youtube.Comment{ID: "fan-link", VideoID: "vid2", AuthorChannelID: "UCfan", Text: "my review https://example.com"})
+	add(youtube.Comment{ID: "stranger-link", VideoID: "vid2", AuthorChannelID: "UCstranger", Text: "visit https://example.com"})
+	for i := range 6 {
+		add(youtube.Comment{ID: fmt.Sprintf("reply%d", i), ParentID: "thread", Text: "same question"})
+	}
+	// Beyond the replies listed with their thread
+	add(youtube.Comment{ID: "spam-reply", ParentID: "thread", Text: "scam, don't click"})
+
+	srv := youtubetest.NewServer(f)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	config := fmt.Sprintf(`CHANNEL_ID: "UCours"
+LOG_DIR: %q
+BANNED_WORDS_FILE: %q
+STATE_FILE: %q
+API_ENDPOINT: %q
+POLL_INTERVAL: "20ms"
+NON_SUBSCRIBER_LINK_ACTION: "hold"
+`, filepath.Join(dir, "logs"), filepath.Join(dir, "banned_words.txt"), filepath.Join(dir, "state.json"), srv.URL)
+	writeFile(t, filepath.Join(dir, "config.yaml"), config)
+	writeFile(t, filepath.Join(dir, "banned_words.txt"), "cheap followers\nscam\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- run(ctx, filepath.Join(dir, "config.yaml")) }()
+
+	waitHeld(t, f, "spam", "spam-reply", "stranger-link")
+	for _, id := range []string{"clean", "thread", "reply5", "fan-link"} {
+		if got := f.Status(id); got != "published" {
+			t.Errorf("status of %s = %q, want published", id, got)
+		}
+	}
+
+	// New comments are picked up by polls, and a failing poll is
+	// retried on the next one
+	f.Fail(youtubetest.ThreadsList, youtubetest.ErrQuotaExceeded)
+	add(youtube.Comment{ID: "new-spam", Text: "SCAM alert"})
+	add(youtube.Comment{ID: "new-clean", Text: "Love it"})
+	waitHeld(t, f, "new-spam")
+
+	// The state follows the newest comment
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(filepath.Join(dir, "state.json"))
+		var state youtube.State
+		if json.Unmarshal(data, &state) == nil && state.Mode == "backfillDone" && state.LastID == "new-clean" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s, want backfillDone at new-clean", data)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after cancel")
+	}
+}
+
+// waitHeld waits until comments are held for review
+func waitHeld(t *testing.T, f *youtubetest.Fake, ids ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for f.Status(id) != "heldForReview" {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s is %q, want heldForReview", id, f.Status(id))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
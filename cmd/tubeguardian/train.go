@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/joshkleinlab/tubeguardian/internal/classifier"
+)
+
+// train implements "tubeguardian train": it trains the classifier model
+// on files of labeled comments, one comment per line. An existing model
+// is updated unless -reset is given.
+func train(args []string) error {
+	flags := flag.NewFlagSet("train", flag.ExitOnError)
+	modelPath := flags.String("model", "configs/model.json", "model file to create or update (CLASSIFIER_MODEL)")
+	spamFile := flags.String("spam", "", "file of spam comments, one per line")
+	hamFile := flags.String("ham", "", "file of ham comments, one per line")
+	reset := flags.Bool("reset", false, "start from an empty model instead of updating the existing one")
+	flags.Parse(args)
+
+	if *spamFile == "" && *hamFile == "" {
+		flags.Usage()
+		return errors.New("nothing to train on: set -spam and/or -ham")
+	}
+
+	model := classifier.New()
+	if !*reset {
+		var err error
+		if model, err = classifier.Load(*modelPath); errors.Is(err, fs.ErrNotExist) {
+			model = classifier.New()
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range []struct {
+		path  string
+		label classifier.Label
+	}{{*spamFile, classifier.Spam}, {*hamFile, classifier.Ham}} {
+		if f.path == "" {
+			continue
+		}
+		n, err := trainFile(model, f.path, f.label)
+		if err != nil {
+			return err
+		}
+		log.Printf("📚 Trained on %d %s comments from %s", n, f.label, f.path)
+	}
+
+	if err := model.Save(*modelPath); err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	spam, ham := model.Docs()
+	log.Printf("💾 Saved %s (%d spam, %d ham comments in total)", *modelPath, spam, ham)
+	return nil
+}
+
+// trainFile trains model on the comments in a file, one per line, and
+// returns how many there were
+func trainFile(model *classifier.Model, path string, label classifier.Label) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if text := strings.TrimSpace(scanner.Text()); text != "" {
+			model.Train(text, label)
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
@@ -10,9 +10,10 @@
 package ahocorasick
 
 import (
-	"container/list"
+	"encoding"
 	"sync"
 	"sync/atomic"
+	"unicode/utf8"
 )
 
 // A node in the trie structure used to implement Aho-Corasick
@@ -25,6 +26,9 @@ type node struct {
 	// be output when matching
 	index int // index into original dictionary if output is true
 
+	runes int // Number of runes in the blice if output is true, used
+	// to find where a match started when matching case folded input
+
 	counter uint64 // Set to the value of the Matcher.counter when a
 	// match is output to prevent duplicate output
 	// The use of fixed size arrays is space-inefficient but fast for
@@ -59,20 +63,35 @@ type Matcher struct {
 
 	heap sync.Pool // a pool of haystacks to de-duplicate results in
 	// a thread-safe manner
+
+	fold bool // true if the dictionary was case folded and input must
+	// be folded while matching
 }
 
-// findBlice looks for a blice in the trie starting from the root and
-// returns a pointer to the node representing the end of the blice. If
-// the blice is not found it returns nil.
-func (m *Matcher) findBlice(b []byte) *node {
-	n := &m.trie[0]
+// Automaton is the matching API shared by Matcher and CompactMatcher,
+// which give the same results for the same dictionary. Code that only
+// matches can hold either, and choose between speed and memory when it
+// builds one.
+type Automaton interface {
+	Match(in []byte) []int
+	MatchThreadSafe(in []byte) []int
+	MatchPositions(in []byte) []Hit
+	Contains(in []byte) bool
+	encoding.BinaryMarshaler
+}
 
-	for n != nil && len(b) > 0 {
-		n = n.child[int(b[0])]
-		b = b[1:]
-	}
+var (
+	_ Automaton = (*Matcher)(nil)
+	_ Automaton = (*CompactMatcher)(nil)
+)
 
-	return n
+// Hit is a single occurrence of a dictionary entry in the input. Index
+// is the index into the original dictionary and [Start, End) are the
+// byte offsets of the occurrence.
+type Hit struct {
+	Index int
+	Start int
+	End   int
 }
 
 // getFreeNode: gets a free node structure from the Matcher's trie
@@ -143,53 +162,64 @@ func (m *Matcher) buildTrie(dictionary [][]byte) {
 
 		n.output = true
 		n.index = i
+		n.runes = utf8.RuneCount(blice)
 	}
 
-	l := new(list.List)
-	l.PushBack(m.root)
+	// Failure links are filled in breadth first. The failure of a child
+	// is found by following the failure links of its parent until a node
+	// with a child for the same byte turns up; parents are shallower
+	// than their children, so their links are already known.
 
-	for l.Len() > 0 {
-		n := l.Remove(l.Front()).(*node)
+	order := []*node{m.root}
+	for k := 0; k < len(order); k++ {
+		n := order[k]
 
 		for i := 0; i < 256; i++ {
 			c := n.child[i]
-			if c != nil {
-				l.PushBack(c)
-
-				for j := 1; j < len(c.b); j++ {
-					c.fail = m.findBlice(c.b[j:])
-					if c.fail != nil {
-						break
-					}
-				}
+			if c == nil {
+				continue
+			}
+			order = append(order, c)
 
-				if c.fail == nil {
-					c.fail = m.root
+			c.fail = m.root
+			if !n.root {
+				f := n.fail
+				for f.child[i] == nil && !f.root {
+					f = f.fail
 				}
-
-				for j := 1; j < len(c.b); j++ {
-					s := m.findBlice(c.b[j:])
-					if s != nil && s.output {
-						c.suffix = s
-						break
-					}
+				if f.child[i] != nil {
+					c.fail = f.child[i]
 				}
 			}
+
+			switch {
+			case c.fail.root:
+				c.suffix = m.root
+			case c.fail.output:
+				c.suffix = c.fail
+			default:
+				c.suffix = c.fail.suffix
+			}
 		}
 	}
 
-	for i := 0; i < m.extent; i++ {
+	linkFails(order)
+
+	m.trie = m.trie[:m.extent]
+}
+
+// linkFails fills in the fails array of every node. The nodes must be
+// in breadth first order so that a node's failure comes before it.
+func linkFails(order []*node) {
+	for _, n := range order {
 		for c := 0; c < 256; c++ {
-			n := &m.trie[i]
-			for n.child[c] == nil && !n.root {
-				n = n.fail
+			if n.child[c] != nil || n.root {
+				n.fails[c] = n
+			} else {
+				n.fails[c] = n.fail.fails[c]
 			}
-
-			m.trie[i].fails[c] = n
 		}
 	}
-
-	m.trie = m.trie[:m.extent]
 }
 
 // NewMatcher creates a new Matcher used to match against a set of
@@ -224,13 +254,18 @@ func NewStringMatcher(dictionary []string) *Matcher {
 func (m *Matcher) Match(in []byte) []int {
 	m.counter++
 
-	return match(in, m.root, func(f *node) bool {
+	unique := func(f *node) bool {
 		if f.counter != m.counter {
 			f.counter = m.counter
 			return true
 		}
 		return false
-	})
+	}
+
+	if m.fold {
+		return m.matchFolded(in, unique)
+	}
+	return match(in, m.root, unique)
 }
 
 // match is a core of matching logic. Accepts input byte slice, starting node
@@ -292,22 +327,77 @@ func (m *Matcher) MatchThreadSafe(in []byte) []int {
 		heap = item.(map[int]uint64)
 	}
 
-	hits := match(in, n, func(f *node) bool {
+	unique := func(f *node) bool {
 		g := heap[f.index]
 		if g != generation {
 			heap[f.index] = generation
 			return true
 		}
 		return false
-	})
+	}
+
+	var hits []int
+	if m.fold {
+		hits = m.matchFolded(in, unique)
+	} else {
+		hits = match(in, n, unique)
+	}
 
 	m.heap.Put(heap)
 	return hits
 }
 
+// MatchPositions searches in for blices and returns every occurrence
+// found, in the order in which they end in the input. Unlike Match it
+// does not de-duplicate: a blice that appears three times is reported
+// three times, each with its own offsets.
+//
+// MatchPositions does not modify the Matcher and is thread-safe.
+func (m *Matcher) MatchPositions(in []byte) []Hit {
+	if m.fold {
+		return m.matchPositionsFolded(in)
+	}
+
+	var hits []Hit
+
+	n := m.root
+	for i, b := range in {
+		c := int(b)
+
+		if !n.root && n.child[c] == nil {
+			n = n.fails[c]
+		}
+
+		if n.child[c] != nil {
+			f := n.child[c]
+			n = f
+
+			if f.output {
+				hits = append(hits, Hit{Index: f.index, Start: i + 1 - len(f.b), End: i + 1})
+			}
+
+			for !f.suffix.root {
+				f = f.suffix
+				hits = append(hits, Hit{Index: f.index, Start: i + 1 - len(f.b), End: i + 1})
+			}
+		}
+	}
+
+	return hits
+}
+
 // Contains returns true if any string matches. This can be faster
 // than Match() when you do not need to know which words matched.
 func (m *Matcher) Contains(in []byte) bool {
+	if m.fold {
+		found := false
+		m.walkFolded(in, func(f *node, _ int) bool {
+			found = f.output || !f.suffix.root
+			return !found
+		})
+		return found
+	}
+
 	n := m.root
 	for _, b := range in {
 		c := int(b)
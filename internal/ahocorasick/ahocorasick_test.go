@@ -5,6 +5,10 @@
 package ahocorasick
 
 import (
+	"encoding"
+	"fmt"
+	"math/rand"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
@@ -328,6 +332,216 @@ func TestContains(t *testing.T) {
 	assert(t, contains == true)
 }
 
+func TestMatchPositions(t *testing.T) {
+	m := NewStringMatcher([]string{"Man", "an", "Steel"})
+	in := []byte("The Man Of Steel: Superman")
+	hits := m.MatchPositions(in)
+	assert(t, len(hits) == 4)
+	assert(t, hits[0] == Hit{Index: 0, Start: 4, End: 7})
+	assert(t, hits[1] == Hit{Index: 1, Start: 5, End: 7})
+	assert(t, hits[2] == Hit{Index: 2, Start: 11, End: 16})
+	assert(t, hits[3] == Hit{Index: 1, Start: 24, End: 26})
+
+	for _, h := range hits {
+		assert(t, string(in[h.Start:h.End]) == []string{"Man", "an", "Steel"}[h.Index])
+	}
+
+	hits = m.MatchPositions([]byte(""))
+	assert(t, len(hits) == 0)
+}
+
+func TestMatchPositionsRepeated(t *testing.T) {
+	m := NewStringMatcher([]string{"a", "ab", "bc", "bca", "c", "caa"})
+	hits := m.MatchPositions([]byte("abccab"))
+	assert(t, len(hits) == 7)
+	assert(t, hits[0] == Hit{Index: 0, Start: 0, End: 1})
+	assert(t, hits[1] == Hit{Index: 1, Start: 0, End: 2})
+	assert(t, hits[2] == Hit{Index: 2, Start: 1, End: 3})
+	assert(t, hits[3] == Hit{Index: 4, Start: 2, End: 3})
+	assert(t, hits[4] == Hit{Index: 4, Start: 3, End: 4})
+	assert(t, hits[5] == Hit{Index: 0, Start: 4, End: 5})
+	assert(t, hits[6] == Hit{Index: 1, Start: 4, End: 6})
+}
+
+func TestFoldRune(t *testing.T) {
+	assert(t, FoldRune('A') == 'a')
+	assert(t, FoldRune('a') == 'a')
+	assert(t, FoldRune('K') == 'k')
+	assert(t, FoldRune('\u212a') == 'k') // Kelvin sign
+	assert(t, FoldRune('ſ') == 's')
+	assert(t, FoldRune('Σ') == FoldRune('ς'))
+	assert(t, FoldRune('Σ') == FoldRune('σ'))
+	assert(t, FoldRune('É') == 'é')
+	assert(t, FoldRune('1') == '1')
+	assert(t, Fold("ΣΊΣΥΦΟΣ") == Fold("σίσυφος"))
+	assert(t, Fold("Straße") == Fold("STRAẞE"))
+	assert(t, Fold("Straße") != Fold("STRASSE")) // simple folding never changes the rune count
+}
+
+func TestFoldingMatcher(t *testing.T) {
+	m := NewFoldingMatcher([]string{"Superman", "STEEL", "man of"})
+	in := []byte("The MAN OF steel: SUPERMAN")
+	hits := m.Match(in)
+	assert(t, len(hits) == 3)
+	assert(t, hits[0] == 2)
+	assert(t, hits[1] == 1)
+	assert(t, hits[2] == 0)
+
+	hits = m.MatchThreadSafe(in)
+	assert(t, len(hits) == 3)
+
+	assert(t, m.Contains([]byte("a steel man")))
+	assert(t, !m.Contains([]byte("a stee1 man")))
+}
+
+func TestFoldingMatcherPositions(t *testing.T) {
+	// "ſ" and the Kelvin sign are wider in UTF-8 than what they fold to
+	m := NewFoldingMatcher([]string{"ask", "Été"})
+	in := []byte("ASK, aſ\u212a, été, ÉTÉ")
+	hits := m.MatchPositions(in)
+	assert(t, len(hits) == 4)
+	assert(t, string(in[hits[0].Start:hits[0].End]) == "ASK")
+	assert(t, string(in[hits[1].Start:hits[1].End]) == "aſ\u212a")
+	assert(t, string(in[hits[2].Start:hits[2].End]) == "été")
+	assert(t, string(in[hits[3].Start:hits[3].End]) == "ÉTÉ")
+	assert(t, hits[3].Index == 1)
+}
+
+func TestFoldingMatcherInvalidUTF8(t *testing.T) {
+	m := NewFoldingMatcher([]string{"abc"})
+	in := []byte("\xffABC\xfe")
+	hits := m.MatchPositions(in)
+	assert(t, len(hits) == 1)
+	assert(t, hits[0] == Hit{Index: 0, Start: 1, End: 4})
+}
+
+func TestCompactMatchesDense(t *testing.T) {
+	dictionaries := [][]string{
+		{},
+		{"Superman", "uperman", "perman", "erman"},
+		{"Superman", "Superma", "Superm", "Super"},
+		{"Steel", "tee", "e"},
+		{"a", "ab", "bc", "bca", "c", "caa"},
+		{"a", "a", "ab", ""},
+		{"Mozilla", "Mac", "Macintosh", "Safari", "Sausage"},
+		dictionary5,
+		dictionary6,
+	}
+	inputs := [][]byte{
+		[]byte(""),
+		[]byte("The Man Of Steel: Superman"),
+		[]byte("abccab"),
+		[]byte("bccab"),
+		[]byte("\xff\x00ab\xc3"),
+		bytes,
+		bytes2,
+	}
+
+	for _, d := range dictionaries {
+		var dense, compact Automaton = NewStringMatcher(d), NewCompactStringMatcher(d)
+		for _, in := range inputs {
+			assert(t, sameResults(dense, compact, in))
+		}
+
+		dense, compact = NewFoldingMatcher(d), NewCompactFoldingMatcher(d)
+		for _, in := range inputs {
+			assert(t, sameResults(dense, compact, []byte(strings.ToUpper(string(in)))))
+		}
+	}
+}
+
+// sameResults reports whether a and b give the same results for in
+func sameResults(a, b Automaton, in []byte) bool {
+	return reflect.DeepEqual(a.Match(in), b.Match(in)) &&
+		reflect.DeepEqual(a.MatchThreadSafe(in), b.MatchThreadSafe(in)) &&
+		reflect.DeepEqual(a.MatchPositions(in), b.MatchPositions(in)) &&
+		a.Contains(in) == b.Contains(in)
+}
+
+func TestCompactMatchesDenseRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	word := func(n int) string {
+		b := make([]byte, 1+r.Intn(n))
+		for i := range b {
+			b[i] = "abcd"[r.Intn(4)]
+		}
+		return string(b)
+	}
+
+	for round := 0; round < 50; round++ {
+		var d []string
+		for i := 0; i < 1+r.Intn(30); i++ {
+			d = append(d, word(6))
+		}
+		var dense, compact Automaton = NewStringMatcher(d), NewCompactStringMatcher(d)
+
+		for i := 0; i < 20; i++ {
+			in := []byte(word(200))
+			if !sameResults(dense, compact, in) {
+				t.Fatalf("dictionary %q, input %q: compact differs from dense", d, in)
+			}
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, d := range [][]string{{}, {"a", "ab", "bc", "bca", "c", "caa"}, dictionary6} {
+		for _, fold := range []bool{false, true} {
+			var dense, compact Automaton
+			if fold {
+				dense, compact = NewFoldingMatcher(d), NewCompactFoldingMatcher(d)
+			} else {
+				dense, compact = NewStringMatcher(d), NewCompactStringMatcher(d)
+			}
+
+			for _, pair := range [][2]Automaton{{dense, new(Matcher)}, {compact, new(CompactMatcher)}} {
+				m, loaded := pair[0], pair[1]
+				data, err := m.MarshalBinary()
+				assert(t, err == nil)
+				assert(t, loaded.(encoding.BinaryUnmarshaler).UnmarshalBinary(data) == nil)
+				for _, in := range [][]byte{bytes, bytes2, []byte("ABCCAB")} {
+					assert(t, sameResults(m, loaded, in))
+				}
+			}
+		}
+	}
+}
+
+func TestUnmarshalBinaryDamaged(t *testing.T) {
+	d := []string{"a", "ab", "bc", "bca", "c", "caa"}
+	denseData, _ := NewStringMatcher(d).MarshalBinary()
+	compactData, _ := NewCompactStringMatcher(d).MarshalBinary()
+
+	// Truncated or mislabelled data is always rejected
+	for i := 0; i < len(denseData); i++ {
+		assert(t, new(Matcher).UnmarshalBinary(denseData[:i]) != nil)
+	}
+	for i := 0; i < len(compactData); i++ {
+		assert(t, new(CompactMatcher).UnmarshalBinary(compactData[:i]) != nil)
+	}
+	assert(t, new(Matcher).UnmarshalBinary(compactData) != nil)
+	assert(t, new(CompactMatcher).UnmarshalBinary(denseData) != nil)
+
+	// Damaged data either fails to load or loads into something that
+	// can still be used safely
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 2000; round++ {
+		dense := append([]byte(nil), denseData...)
+		compact := append([]byte(nil), compactData...)
+		dense[r.Intn(len(dense))] ^= byte(1 + r.Intn(255))
+		compact[r.Intn(len(compact))] ^= byte(1 + r.Intn(255))
+
+		if m := new(Matcher); m.UnmarshalBinary(dense) == nil {
+			m.Match([]byte("abccab"))
+			m.MatchPositions([]byte("abccab"))
+		}
+		if m := new(CompactMatcher); m.UnmarshalBinary(compact) == nil {
+			m.Match([]byte("abccab"))
+			m.MatchPositions([]byte("abccab"))
+		}
+	}
+}
+
 var bytes = []byte("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_7_5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/30.0.1599.101 Safari/537.36")
 var sbytes = string(bytes)
 var dictionary = []string{"Mozilla", "Mac", "Macintosh", "Safari", "Sausage"}
@@ -345,6 +559,21 @@ func BenchmarkMatchThreadSafeWorks(b *testing.B) {
 	}
 }
 
+func BenchmarkMatchPositionsWorks(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		precomputed.MatchPositions(bytes)
+	}
+}
+
+var precomputedFolding = NewFoldingMatcher(dictionary)
+
+func BenchmarkFoldingMatchWorks(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		precomputedFolding.Match(bytes)
+	}
+}
+
 func BenchmarkContainsWorks(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		hits := make([]int, 0)
@@ -533,3 +762,92 @@ func BenchmarkLargeMatchThreadSafeWorks(b *testing.B) {
 		precomputed6.MatchThreadSafe(bytes2)
 	}
 }
+
+// largeDictionary returns n distinct multilingual phrases, for
+// comparing the memory used by Matcher and CompactMatcher
+func largeDictionary(n int) []string {
+	words := []string{"free", "crypto", "gift", "ganhe", "dinheiro", "regalo", "gratis", "पैसे", "मुफ्त", "subscribe", "click", "link", "bio", "telegram", "whatsapp", "invest"}
+	r := rand.New(rand.NewSource(1))
+	seen := make(map[string]bool)
+	var d []string
+	for len(d) < n {
+		p := fmt.Sprintf("%s %s %s", words[r.Intn(len(words))], words[r.Intn(len(words))], words[r.Intn(len(words))])
+		if !seen[p] {
+			seen[p] = true
+			d = append(d, p)
+		}
+	}
+	return d
+}
+
+var dictionary7 = largeDictionary(2000)
+
+func BenchmarkBuildLarge(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewStringMatcher(dictionary7)
+	}
+}
+
+func BenchmarkCompactBuildLarge(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewCompactStringMatcher(dictionary7)
+	}
+}
+
+var input7 = []byte(strings.Repeat("click the link in bio for free crypto, ganhe dinheiro gratis मुफ्त पैसे ", 20))
+
+// The large matchers are built by their benchmarks, not at package init:
+// the dense one takes over 100 MB.
+
+func BenchmarkLargeDictionaryMatchPositions(b *testing.B) {
+	m := NewStringMatcher(dictionary7)
+	b.SetBytes(int64(len(input7)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MatchPositions(input7)
+	}
+}
+
+func BenchmarkCompactLargeDictionaryMatchPositions(b *testing.B) {
+	m := NewCompactStringMatcher(dictionary7)
+	b.SetBytes(int64(len(input7)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.MatchPositions(input7)
+	}
+}
+
+var compact = NewCompactStringMatcher(dictionary)
+
+func BenchmarkCompactMatchWorks(b *testing.B) {
+	b.SetBytes(int64(len(bytes)))
+	for i := 0; i < b.N; i++ {
+		compact.Match(bytes)
+	}
+}
+
+func BenchmarkCompactMatchThreadSafeWorks(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		compact.MatchThreadSafe(bytes)
+	}
+}
+
+var compact6 = NewCompactStringMatcher(dictionary6)
+
+func BenchmarkCompactLargeMatchWorks(b *testing.B) {
+	b.SetBytes(int64(len(bytes2)))
+	for i := 0; i < b.N; i++ {
+		compact6.Match(bytes2)
+	}
+}
+
+func BenchmarkCompactUnmarshalLarge(b *testing.B) {
+	data, _ := NewCompactStringMatcher(dictionary7).MarshalBinary()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		new(CompactMatcher).UnmarshalBinary(data)
+	}
+}
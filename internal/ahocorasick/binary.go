@@ -0,0 +1,370 @@
+// binary.go: saving and loading compiled automata, so that a large
+// dictionary does not have to be compiled again on every start.
+//
+// Both Matcher and CompactMatcher implement encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler. The encodings are little endian and
+// start with a four byte magic number that includes a format version.
+// Loading checks that every link points inside the automaton, so a
+// damaged file gives an error rather than a Matcher that panics.
+
+package ahocorasick
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	denseMagic   = [4]byte{'A', 'C', 'D', '1'}
+	compactMagic = [4]byte{'A', 'C', 'C', '1'}
+)
+
+// ErrFormat is returned when loading data that is not a valid encoding
+// of the automaton being loaded
+var ErrFormat = errors.New("ahocorasick: invalid encoding")
+
+// encoder appends values to buf in order
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) write(v any) {
+	// Only fixed size values are written, so this cannot fail
+	e.buf, _ = binary.Append(e.buf, binary.LittleEndian, v)
+}
+
+// decoder reads values from buf in order and keeps the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) read(v any) {
+	if d.err != nil {
+		return
+	}
+	n, err := binary.Decode(d.buf, binary.LittleEndian, v)
+	if err != nil {
+		d.err = io.ErrUnexpectedEOF
+		return
+	}
+	d.buf = d.buf[n:]
+}
+
+// count reads a length and checks that at least size bytes per element
+// are left to read, so that a damaged length cannot cause a huge
+// allocation
+func (d *decoder) count(size int) int {
+	var n uint32
+	d.read(&n)
+	if d.err == nil && int64(n)*int64(size) > int64(len(d.buf)) {
+		d.err = io.ErrUnexpectedEOF
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// finish returns the first error, or an error if data was left over
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.buf))
+	}
+	if d.err != nil {
+		return fmt.Errorf("%w: %v", ErrFormat, d.err)
+	}
+	return nil
+}
+
+// boolByte encodes a bool as a byte
+func boolByte(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MarshalBinary encodes the compiled trie. The fails arrays are not
+// stored, since they can be recomputed in linear time from the failure
+// links.
+func (m *Matcher) MarshalBinary() ([]byte, error) {
+	index := make(map[*node]int32, len(m.trie))
+	for i := range m.trie {
+		index[&m.trie[i]] = int32(i)
+	}
+	ref := func(n *node) int32 {
+		if n == nil {
+			return -1
+		}
+		return index[n]
+	}
+
+	// Nodes only know their children, so collect each node's parent
+	parent := make([]int32, len(m.trie))
+	label := make([]uint8, len(m.trie))
+	parent[0] = -1
+	for i := range m.trie {
+		for c, child := range m.trie[i].child {
+			if child != nil {
+				parent[index[child]] = int32(i)
+				label[index[child]] = uint8(c)
+			}
+		}
+	}
+
+	var e encoder
+	e.write(denseMagic)
+	e.write(boolByte(m.fold))
+	e.write(uint32(len(m.trie)))
+	for i := range m.trie {
+		n := &m.trie[i]
+		e.write(parent[i])
+		e.write(label[i])
+		e.write(boolByte(n.output))
+		e.write(int32(n.index))
+		e.write(int32(n.runes))
+		e.write(ref(n.fail))
+		e.write(ref(n.suffix))
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary loads a trie encoded by MarshalBinary into m, which
+// must be a new, unused Matcher
+func (m *Matcher) UnmarshalBinary(data []byte) error {
+	d := decoder{buf: data}
+
+	var magic [4]byte
+	var fold uint8
+	d.read(&magic)
+	if d.err == nil && magic != denseMagic {
+		d.err = fmt.Errorf("bad magic %q", magic[:])
+	}
+	d.read(&fold)
+	n := d.count(22)
+	if d.err == nil && n == 0 {
+		d.err = errors.New("no root")
+	}
+	if d.err != nil {
+		return d.finish()
+	}
+
+	trie := make([]node, n)
+	trie[0].root = true
+	for i := range trie {
+		var parent, index, runes, fail, suffix int32
+		var label, output uint8
+		d.read(&parent)
+		d.read(&label)
+		d.read(&output)
+		d.read(&index)
+		d.read(&runes)
+		d.read(&fail)
+		d.read(&suffix)
+		if d.err != nil {
+			break
+		}
+
+		// Nodes are stored in the order they were created, so a
+		// parent always comes before its children
+		inRange := func(j int32) bool { return j >= 0 && int(j) < n }
+		if i == 0 && (parent != -1 || fail != -1 || suffix != -1) ||
+			i > 0 && (!inRange(parent) || int(parent) >= i || !inRange(fail) || !inRange(suffix)) {
+			d.err = fmt.Errorf("node %d: link out of range", i)
+			break
+		}
+
+		c := &trie[i]
+		c.output = output != 0
+		c.index = int(index)
+		c.runes = int(runes)
+		if i > 0 {
+			p := &trie[parent]
+			if p.child[label] != nil {
+				d.err = fmt.Errorf("node %d: duplicate child", i)
+				break
+			}
+			p.child[label] = c
+			c.b = append(append(make([]byte, 0, len(p.b)+1), p.b...), label)
+			c.fail = &trie[fail]
+			c.suffix = &trie[suffix]
+		}
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+
+	order := []*node{&trie[0]}
+	for k := 0; k < len(order); k++ {
+		for _, c := range order[k].child {
+			if c != nil {
+				order = append(order, c)
+			}
+		}
+	}
+	if len(order) != n {
+		return fmt.Errorf("%w: %d nodes not reachable from the root", ErrFormat, n-len(order))
+	}
+	for _, c := range order[1:] {
+		if len(c.fail.b) >= len(c.b) || len(c.suffix.b) >= len(c.b) {
+			return fmt.Errorf("%w: link does not lead to a shorter suffix", ErrFormat)
+		}
+	}
+
+	m.trie = trie
+	m.extent = n
+	m.root = &trie[0]
+	m.fold = fold != 0
+	linkFails(order)
+	return nil
+}
+
+// MarshalBinary encodes the compiled automaton
+func (m *CompactMatcher) MarshalBinary() ([]byte, error) {
+	var e encoder
+	e.write(compactMagic)
+	e.write(boolByte(m.fold))
+	e.write(m.classes)
+	e.write(uint32(len(m.rootNext)))
+	e.write(m.rootNext)
+	e.write(uint32(len(m.fail)))
+	e.write(m.first)
+	e.write(m.fail)
+	e.write(m.suffix)
+	e.write(m.index)
+	e.write(m.length)
+	e.write(m.runes)
+	e.write(uint32(len(m.label)))
+	e.write(m.label)
+	e.write(m.target)
+	return e.buf, nil
+}
+
+// UnmarshalBinary loads an automaton encoded by MarshalBinary into m,
+// which must be a new, unused CompactMatcher
+func (m *CompactMatcher) UnmarshalBinary(data []byte) error {
+	d := decoder{buf: data}
+
+	var magic [4]byte
+	var fold uint8
+	var c CompactMatcher
+	d.read(&magic)
+	if d.err == nil && magic != compactMagic {
+		d.err = fmt.Errorf("bad magic %q", magic[:])
+	}
+	d.read(&fold)
+	d.read(&c.classes)
+
+	c.rootNext = make([]int32, d.count(4))
+	d.read(c.rootNext)
+
+	n := d.count(24)
+	c.first = make([]int32, n+1)
+	c.fail = make([]int32, n)
+	c.suffix = make([]int32, n)
+	c.index = make([]int32, n)
+	c.length = make([]int32, n)
+	c.runes = make([]int32, n)
+	for _, s := range [][]int32{c.first, c.fail, c.suffix, c.index, c.length, c.runes} {
+		d.read(s)
+	}
+
+	e := d.count(6)
+	c.label = make([]uint16, e)
+	c.target = make([]int32, e)
+	d.read(c.label)
+	d.read(c.target)
+
+	if err := d.finish(); err != nil {
+		return err
+	}
+	if err := c.check(); err != nil {
+		return fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+
+	m.classes = c.classes
+	m.rootNext = c.rootNext
+	m.first, m.label, m.target = c.first, c.label, c.target
+	m.fail, m.suffix = c.fail, c.suffix
+	m.index, m.length, m.runes = c.index, c.length, c.runes
+	m.fold = fold != 0
+	m.seen = make([]uint64, n)
+	return nil
+}
+
+// check verifies that every class, state and transition reference in a
+// loaded automaton is in range, and that failure and suffix links lead
+// to shallower states so that following them always ends at the root
+func (m *CompactMatcher) check() error {
+	n := int32(len(m.fail))
+	nclasses := len(m.rootNext)
+	if n == 0 || nclasses == 0 {
+		return errors.New("no root")
+	}
+	for _, c := range m.classes {
+		if int(c) >= nclasses {
+			return errors.New("byte class out of range")
+		}
+	}
+	if m.first[0] != 0 || int(m.first[n]) != len(m.label) {
+		return errors.New("transition table size mismatch")
+	}
+	for s := int32(0); s < n; s++ {
+		if m.first[s] > m.first[s+1] {
+			return errors.New("transition table out of order")
+		}
+	}
+	for i, l := range m.label {
+		if int(l) == 0 || int(l) >= nclasses || m.target[i] <= 0 || m.target[i] >= n {
+			return errors.New("transition out of range")
+		}
+	}
+
+	// Every state but the root must be reached by exactly one
+	// transition, which also gives each state its depth
+	depth := make([]int32, n)
+	for i := range depth {
+		depth[i] = -1
+	}
+	depth[0] = 0
+	queue := []int32{0}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for i := m.first[s]; i < m.first[s+1]; i++ {
+			t := m.target[i]
+			if depth[t] >= 0 {
+				return errors.New("state reached twice")
+			}
+			depth[t] = depth[s] + 1
+			queue = append(queue, t)
+		}
+	}
+	for s := int32(0); s < n; s++ {
+		if depth[s] < 0 {
+			return errors.New("state not reachable from the root")
+		}
+	}
+	for c, t := range m.rootNext {
+		if t < 0 || t >= n || t != 0 && depth[t] != 1 {
+			return fmt.Errorf("root transition for class %d out of range", c)
+		}
+	}
+
+	for s := int32(1); s < n; s++ {
+		f, x := m.fail[s], m.suffix[s]
+		if f < 0 || f >= n || depth[f] >= depth[s] {
+			return errors.New("failure link out of range")
+		}
+		if x < -1 || x >= n || x >= 0 && (depth[x] >= depth[s] || m.index[x] < 0) {
+			return errors.New("suffix link out of range")
+		}
+		if m.index[s] >= 0 && (m.length[s] != depth[s] || m.runes[s] <= 0 || m.runes[s] > m.length[s]) {
+			return errors.New("output length out of range")
+		}
+	}
+	return nil
+}
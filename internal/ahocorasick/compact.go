@@ -0,0 +1,357 @@
+// compact.go: a memory-compact representation of the Aho-Corasick
+// automaton.
+//
+// Matcher gives every trie node two [256]*node arrays, which is fast but
+// costs about 4KB per node: a dictionary of tens of thousands of phrases
+// needs hundreds of MB. CompactMatcher stores the same automaton in a
+// few flat slices instead:
+//
+//   - bytes are mapped to classes first. Every byte that appears in the
+//     dictionary gets a class of its own and all other bytes share class
+//     0, which no transition uses, so they send the automaton straight
+//     back to the root;
+//   - the root has a dense transition table indexed by class, because
+//     most input bytes are read at or near the root;
+//   - every other state keeps only the transitions it really has, as a
+//     sorted run of (class, target) pairs in two shared slices, and
+//     follows its failure link when a class is missing.
+//
+// A state then costs a few dozen bytes plus six bytes per transition.
+// Lookups are a short scan instead of an array index, so matching is
+// somewhat slower than with Matcher; see the benchmarks in
+// ahocorasick_test.go.
+
+package ahocorasick
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// CompactMatcher is returned by NewCompactMatcher and friends. Like
+// Matcher it is an Automaton, and gives the same results.
+type CompactMatcher struct {
+	counter uint64 // generation counter used to de-duplicate results
+	seen    []uint64
+
+	classes  [256]uint16 // byte → class, 0 for bytes not in any blice
+	rootNext []int32     // transitions from the root, indexed by class
+
+	first  []int32  // transitions of state s are first[s]:first[s+1]
+	label  []uint16 // class of each transition, sorted within a state
+	target []int32  // state each transition leads to
+
+	fail   []int32 // failure link of each state
+	suffix []int32 // next state with output along the failure links, or -1
+	index  []int32 // index into the original dictionary, or -1
+	length []int32 // length of the blice in bytes for output states
+	runes  []int32 // length of the blice in runes for output states
+
+	heap sync.Pool // a pool of haystacks for MatchThreadSafe
+
+	fold bool // input is case folded while matching
+}
+
+// NewCompactMatcher creates a new CompactMatcher used to match against
+// a set of blices
+func NewCompactMatcher(dictionary [][]byte) *CompactMatcher {
+	m := new(CompactMatcher)
+	m.build(dictionary)
+	return m
+}
+
+// NewCompactStringMatcher creates a new CompactMatcher used to match
+// against a set of strings
+func NewCompactStringMatcher(dictionary []string) *CompactMatcher {
+	var d [][]byte
+	for _, s := range dictionary {
+		d = append(d, []byte(s))
+	}
+	return NewCompactMatcher(d)
+}
+
+// NewCompactFoldingMatcher creates a new CompactMatcher that matches
+// against a set of strings ignoring case, like NewFoldingMatcher
+func NewCompactFoldingMatcher(dictionary []string) *CompactMatcher {
+	var d [][]byte
+	for _, s := range dictionary {
+		d = append(d, []byte(Fold(s)))
+	}
+	m := &CompactMatcher{fold: true}
+	m.build(d)
+	return m
+}
+
+// edge is a transition used while the automaton is being built
+type edge struct {
+	label  uint16
+	target int32
+}
+
+// build constructs the automaton for dictionary
+func (m *CompactMatcher) build(dictionary [][]byte) {
+	// Assign byte classes in byte order
+	var used [256]bool
+	for _, blice := range dictionary {
+		for _, b := range blice {
+			used[b] = true
+		}
+	}
+	nclasses := 1
+	for b := 0; b < 256; b++ {
+		if used[b] {
+			m.classes[b] = uint16(nclasses)
+			nclasses++
+		}
+	}
+
+	// Build the trie with per-state transition lists
+	edges := [][]edge{nil}
+	m.index = []int32{-1}
+	m.length = []int32{0}
+	m.runes = []int32{0}
+
+	child := func(s int32, c uint16) int32 {
+		for _, e := range edges[s] {
+			if e.label == c {
+				return e.target
+			}
+		}
+		return -1
+	}
+
+	for i, blice := range dictionary {
+		s := int32(0)
+		for _, b := range blice {
+			c := m.classes[b]
+			t := child(s, c)
+			if t < 0 {
+				t = int32(len(edges))
+				edges = append(edges, nil)
+				m.index = append(m.index, -1)
+				m.length = append(m.length, 0)
+				m.runes = append(m.runes, 0)
+				edges[s] = append(edges[s], edge{label: c, target: t})
+			}
+			s = t
+		}
+
+		if s != 0 {
+			m.index[s] = int32(i)
+			m.length[s] = int32(len(blice))
+			m.runes[s] = int32(utf8.RuneCount(blice))
+		}
+	}
+
+	// Failure and suffix links, breadth first so that the links of
+	// shallower states are known when deeper states need them
+	n := len(edges)
+	m.fail = make([]int32, n)
+	m.suffix = make([]int32, n)
+	m.suffix[0] = -1
+
+	queue := make([]int32, 0, n)
+	for _, e := range edges[0] {
+		m.fail[e.target] = 0
+		m.suffix[e.target] = -1
+		queue = append(queue, e.target)
+	}
+
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		for _, e := range edges[s] {
+			t := e.target
+			queue = append(queue, t)
+
+			f := m.fail[s]
+			for f != 0 && child(f, e.label) < 0 {
+				f = m.fail[f]
+			}
+			if g := child(f, e.label); g >= 0 && g != t {
+				m.fail[t] = g
+			}
+
+			if g := m.fail[t]; m.index[g] >= 0 {
+				m.suffix[t] = g
+			} else {
+				m.suffix[t] = m.suffix[g]
+			}
+		}
+	}
+
+	// Flatten the transition lists
+	m.rootNext = make([]int32, nclasses)
+	for _, e := range edges[0] {
+		m.rootNext[e.label] = e.target
+	}
+
+	m.first = make([]int32, n+1)
+	for s, es := range edges {
+		sort.Slice(es, func(i, j int) bool { return es[i].label < es[j].label })
+		m.first[s+1] = m.first[s] + int32(len(es))
+	}
+	m.label = make([]uint16, 0, m.first[n])
+	m.target = make([]int32, 0, m.first[n])
+	for _, es := range edges {
+		for _, e := range es {
+			m.label = append(m.label, e.label)
+			m.target = append(m.target, e.target)
+		}
+	}
+
+	m.seen = make([]uint64, n)
+}
+
+// next returns the state reached from s by reading byte b, or 0 (the
+// root) if no blice continues that way
+func (m *CompactMatcher) next(s int32, b byte) int32 {
+	c := m.classes[b]
+	if c == 0 {
+		return 0
+	}
+
+	for s != 0 {
+		for i := m.first[s]; i < m.first[s+1]; i++ {
+			if m.label[i] == c {
+				return m.target[i]
+			}
+			if m.label[i] > c {
+				break
+			}
+		}
+		s = m.fail[s]
+	}
+	return m.rootNext[c]
+}
+
+// walk runs the automaton over in, folding it on the way if the
+// dictionary was folded. visit is called with every state other than
+// the root that is reached, and the offset in in just past the byte or
+// rune being read. The walk stops when visit returns false.
+func (m *CompactMatcher) walk(in []byte, visit func(s int32, end int) bool) {
+	s := int32(0)
+
+	if !m.fold {
+		for i, b := range in {
+			if s = m.next(s, b); s != 0 && !visit(s, i+1) {
+				return
+			}
+		}
+		return
+	}
+
+	var buf [utf8.UTFMax]byte
+	var folded []byte
+	for i := 0; i < len(in); {
+		folded, i = foldNext(in, i, &buf)
+		for _, b := range folded {
+			if s = m.next(s, b); s != 0 && !visit(s, i) {
+				return
+			}
+		}
+	}
+}
+
+// collect returns the dictionary indexes found in in, reporting every
+// output state only once as decided by unique
+func (m *CompactMatcher) collect(in []byte, unique func(s int32) bool) []int {
+	var hits []int
+
+	m.walk(in, func(s int32, _ int) bool {
+		if m.index[s] >= 0 && unique(s) {
+			hits = append(hits, int(m.index[s]))
+		}
+
+		for f := m.suffix[s]; f >= 0; f = m.suffix[f] {
+			if !unique(f) {
+				// Already reported along with the rest of its suffixes
+				break
+			}
+			hits = append(hits, int(m.index[f]))
+		}
+		return true
+	})
+
+	return hits
+}
+
+// Match searches in for blices and returns all the blices found as
+// indexes into the original dictionary.
+//
+// This is not thread-safe method, seek for MatchThreadSafe() instead.
+func (m *CompactMatcher) Match(in []byte) []int {
+	m.counter++
+
+	return m.collect(in, func(s int32) bool {
+		if m.seen[s] != m.counter {
+			m.seen[s] = m.counter
+			return true
+		}
+		return false
+	})
+}
+
+// MatchThreadSafe provides the same result as Match() but does it in a
+// thread-safe manner.
+func (m *CompactMatcher) MatchThreadSafe(in []byte) []int {
+	var heap map[int32]uint64
+
+	generation := atomic.AddUint64(&m.counter, 1)
+	item := m.heap.Get()
+	if item == nil {
+		heap = make(map[int32]uint64)
+	} else {
+		heap = item.(map[int32]uint64)
+	}
+
+	hits := m.collect(in, func(s int32) bool {
+		if heap[m.index[s]] != generation {
+			heap[m.index[s]] = generation
+			return true
+		}
+		return false
+	})
+
+	m.heap.Put(heap)
+	return hits
+}
+
+// MatchPositions returns every occurrence of a blice in in, like
+// Matcher.MatchPositions. It does not modify the CompactMatcher and is
+// thread-safe.
+func (m *CompactMatcher) MatchPositions(in []byte) []Hit {
+	var hits []Hit
+
+	hit := func(s int32, end int) Hit {
+		if m.fold {
+			return Hit{Index: int(m.index[s]), Start: runesBefore(in, end, int(m.runes[s])), End: end}
+		}
+		return Hit{Index: int(m.index[s]), Start: end - int(m.length[s]), End: end}
+	}
+
+	m.walk(in, func(s int32, end int) bool {
+		if m.index[s] >= 0 {
+			hits = append(hits, hit(s, end))
+		}
+		for f := m.suffix[s]; f >= 0; f = m.suffix[f] {
+			hits = append(hits, hit(f, end))
+		}
+		return true
+	})
+
+	return hits
+}
+
+// Contains returns true if any string matches
+func (m *CompactMatcher) Contains(in []byte) bool {
+	found := false
+	m.walk(in, func(s int32, _ int) bool {
+		found = m.index[s] >= 0 || m.suffix[s] >= 0
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,175 @@
+// fold.go: case-insensitive matching. The dictionary is case folded
+// when the trie is built and the input is folded one rune at a time
+// while it is being matched, so no folded copy of the input is made.
+//
+// Folding follows Unicode simple case folding: two runes are equal if
+// one can be reached from the other through unicode.SimpleFold. Every
+// rune is replaced by a fixed member of its folding orbit (the
+// lowercase one where there is one), so "K", "k" and the Kelvin sign
+// all fold to "k", and "ſ", "S" and "s" all fold to "s".
+
+package ahocorasick
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// FoldRune returns the member of r's simple case folding orbit that is
+// used to represent all of them: the smallest lowercase rune in the
+// orbit, or the smallest rune if none of them is lowercase.
+func FoldRune(r rune) rune {
+	if r < utf8.RuneSelf {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}
+
+	best, lower := r, unicode.IsLower(r)
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		l := unicode.IsLower(f)
+		if (l && !lower) || (l == lower && f < best) {
+			best, lower = f, l
+		}
+	}
+	return best
+}
+
+// Fold returns s with every rune replaced by FoldRune. Bytes that are
+// not valid UTF-8 are kept as they are.
+func Fold(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[i])
+		} else {
+			b = utf8.AppendRune(b, FoldRune(r))
+		}
+		i += size
+	}
+	return string(b)
+}
+
+// NewFoldingMatcher creates a new Matcher that matches against a set of
+// strings ignoring case. Hits report offsets into the input as given,
+// not into a folded copy of it.
+func NewFoldingMatcher(dictionary []string) *Matcher {
+	m := new(Matcher)
+	m.fold = true
+
+	var d [][]byte
+	for _, s := range dictionary {
+		d = append(d, []byte(Fold(s)))
+	}
+
+	m.buildTrie(d)
+
+	return m
+}
+
+// foldNext folds the rune starting at in[i] into buf and returns its
+// folded bytes and the offset of the next rune. Invalid bytes are
+// returned unchanged, one at a time.
+func foldNext(in []byte, i int, buf *[utf8.UTFMax]byte) ([]byte, int) {
+	if b := in[i]; b < utf8.RuneSelf {
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		buf[0] = b
+		return buf[:1], i + 1
+	}
+
+	r, size := utf8.DecodeRune(in[i:])
+	if r == utf8.RuneError && size == 1 {
+		return in[i : i+1], i + 1
+	}
+	return buf[:utf8.EncodeRune(buf[:], FoldRune(r))], i + size
+}
+
+// runesBefore returns the offset in in that lies count runes before end
+func runesBefore(in []byte, end, count int) int {
+	for k := 0; k < count && end > 0; k++ {
+		_, size := utf8.DecodeLastRune(in[:end])
+		end -= size
+	}
+	return end
+}
+
+// walkFolded runs the trie over in, folding each rune into a small
+// buffer on the stack before feeding its bytes to the trie. visit is
+// called with every node reached through a child pointer and the offset
+// in in just past the rune being read. The walk stops when visit
+// returns false.
+func (m *Matcher) walkFolded(in []byte, visit func(f *node, end int) bool) {
+	var buf [utf8.UTFMax]byte
+	var folded []byte
+
+	n := m.root
+	for i := 0; i < len(in); {
+		folded, i = foldNext(in, i, &buf)
+
+		for _, b := range folded {
+			c := int(b)
+
+			if !n.root && n.child[c] == nil {
+				n = n.fails[c]
+			}
+
+			if n.child[c] != nil {
+				n = n.child[c]
+				if !visit(n, i) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// matchFolded is match for a folding Matcher
+func (m *Matcher) matchFolded(in []byte, unique func(f *node) bool) []int {
+	var hits []int
+
+	m.walkFolded(in, func(f *node, _ int) bool {
+		if f.output {
+			if unique(f) {
+				hits = append(hits, f.index)
+			}
+		}
+
+		for !f.suffix.root {
+			f = f.suffix
+			if unique(f) {
+				hits = append(hits, f.index)
+			} else {
+				break
+			}
+		}
+		return true
+	})
+
+	return hits
+}
+
+// matchPositionsFolded is MatchPositions for a folding Matcher. Folding
+// can change the length of a rune in bytes but never the number of
+// runes, so the start of a hit is found by stepping back over as many
+// runes of the input as the blice has.
+func (m *Matcher) matchPositionsFolded(in []byte) []Hit {
+	var hits []Hit
+
+	m.walkFolded(in, func(f *node, end int) bool {
+		if f.output {
+			hits = append(hits, Hit{Index: f.index, Start: runesBefore(in, end, f.runes), End: end})
+		}
+
+		for !f.suffix.root {
+			f = f.suffix
+			hits = append(hits, Hit{Index: f.index, Start: runesBefore(in, end, f.runes), End: end})
+		}
+		return true
+	})
+
+	return hits
+}
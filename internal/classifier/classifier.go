@@ -0,0 +1,237 @@
+// Package classifier estimates how likely a comment is spam from the
+// comments moderators have already labeled, to catch what keyword lists
+// miss.
+//
+// The built-in Model is a multinomial naive Bayes classifier over word
+// tokens, word pairs and character n-grams. It trains in a single pass,
+// can learn and unlearn one comment at a time, and is saved as JSON.
+package classifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+	"github.com/joshkleinlab/tubeguardian/internal/filter"
+)
+
+// Classifier estimates the probability that a comment is spam
+type Classifier interface {
+	Classify(ctx context.Context, text string) (float64, error)
+}
+
+// Label is the class of a labeled comment
+type Label string
+
+const (
+	// Spam is a comment that should be hidden
+	Spam Label = "spam"
+	// Ham is a comment that should be published
+	Ham Label = "ham"
+)
+
+// ErrUntrained is returned by Model.Classify until the model has seen
+// comments of both labels
+var ErrUntrained = errors.New("classifier has not seen both spam and ham yet")
+
+// modelVersion is the version of the model file format
+const modelVersion = 1
+
+// Model is a multinomial naive Bayes classifier. It is safe for
+// concurrent use.
+type Model struct {
+	mu     sync.RWMutex
+	docs   map[Label]int
+	counts map[Label]map[string]int // feature counts by label
+	totals map[Label]int            // sum of counts by label
+	vocab  map[string]int           // feature counts over both labels
+}
+
+// New creates an empty Model
+func New() *Model {
+	return &Model{
+		docs:   map[Label]int{Spam: 0, Ham: 0},
+		counts: map[Label]map[string]int{Spam: {}, Ham: {}},
+		totals: map[Label]int{Spam: 0, Ham: 0},
+		vocab:  make(map[string]int),
+	}
+}
+
+// ParseLabel parses "spam" or "ham"
+func ParseLabel(s string) (Label, error) {
+	switch l := Label(strings.ToLower(strings.TrimSpace(s))); l {
+	case Spam, Ham:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown label %q", s)
+}
+
+// Train adds a labeled comment to the model
+func (m *Model) Train(text string, label Label) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(text, label, 1)
+}
+
+// Forget removes a comment that was trained with label, for example
+// when it turns out to have been labeled wrong
+func (m *Model) Forget(text string, label Label) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(text, label, -1)
+}
+
+// add adds the features of text to label's counts, delta times. Counts
+// never go below zero.
+func (m *Model) add(text string, label Label, delta int) {
+	if _, ok := m.docs[label]; !ok {
+		return
+	}
+	m.docs[label] = max(m.docs[label]+delta, 0)
+	for _, f := range Features(text) {
+		old := m.counts[label][f]
+		n := max(old+delta, 0)
+		if n == 0 {
+			delete(m.counts[label], f)
+		} else {
+			m.counts[label][f] = n
+		}
+		m.totals[label] += n - old
+		m.vocab[f] += n - old
+		if m.vocab[f] == 0 {
+			delete(m.vocab, f)
+		}
+	}
+}
+
+// Docs returns how many comments of each label the model was trained on
+func (m *Model) Docs() (spam, ham int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.docs[Spam], m.docs[Ham]
+}
+
+// Classify returns the probability that text is spam. Features the
+// model has never seen are ignored, and those seen with one label only
+// are smoothed (add-one), so a single word never decides alone.
+func (m *Model) Classify(_ context.Context, text string) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.docs[Spam] == 0 || m.docs[Ham] == 0 {
+		return 0, ErrUntrained
+	}
+
+	v := float64(len(m.vocab))
+	all := float64(m.docs[Spam] + m.docs[Ham])
+	logp := make(map[Label]float64)
+	for _, l := range []Label{Spam, Ham} {
+		logp[l] = math.Log(float64(m.docs[l]) / all)
+	}
+	for _, f := range Features(text) {
+		if m.vocab[f] == 0 {
+			continue
+		}
+		for _, l := range []Label{Spam, Ham} {
+			logp[l] += math.Log(float64(m.counts[l][f]+1) / (float64(m.totals[l]) + v))
+		}
+	}
+	return 1 / (1 + math.Exp(logp[Ham]-logp[Spam])), nil
+}
+
+// Features returns the features of a comment: its words, pairs of
+// adjacent words, and the character 3- and 4-grams of every word,
+// computed on the normalized, case folded text. A feature that occurs
+// several times is returned as many times.
+func Features(text string) []string {
+	words := strings.FieldsFunc(filter.Normalize(text).Text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+
+	var features []string
+	for i, w := range words {
+		w = ahocorasick.Fold(w)
+		words[i] = w
+		features = append(features, "w:"+w)
+		if i > 0 {
+			features = append(features, "b:"+words[i-1]+" "+w)
+		}
+
+		runes := []rune(" " + w + " ")
+		for n := 3; n <= 4; n++ {
+			for j := 0; j+n <= len(runes); j++ {
+				features = append(features, "c:"+string(runes[j:j+n]))
+			}
+		}
+	}
+	return features
+}
+
+// modelFile is the layout of a saved model
+type modelFile struct {
+	Version  int                      `json:"version"`
+	Docs     map[Label]int            `json:"docs"`
+	Features map[Label]map[string]int `json:"features"`
+}
+
+// Load reads a model saved with Save
+func Load(path string) (*Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f modelFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.Version != modelVersion {
+		return nil, fmt.Errorf("%s: unsupported model version %d", path, f.Version)
+	}
+
+	m := New()
+	for _, l := range []Label{Spam, Ham} {
+		m.docs[l] = f.Docs[l]
+		for feature, n := range f.Features[l] {
+			if n <= 0 {
+				continue
+			}
+			m.counts[l][feature] = n
+			m.totals[l] += n
+			m.vocab[feature] += n
+		}
+	}
+	return m, nil
+}
+
+// Save writes the model to path as JSON. The file is replaced
+// atomically, so a crash never leaves half a model behind.
+func (m *Model) Save(path string) error {
+	m.mu.RLock()
+	data, err := json.Marshal(modelFile{Version: modelVersion, Docs: m.docs, Features: m.counts})
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,140 @@
+package classifier
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var (
+	spam = []string{
+		"Check out my channel for free crypto giveaways!!",
+		"I made $5000 this week with this trading bot, DM me on telegram",
+		"Free iPhone giveaway, click the link in my bio",
+		"Message me on WhatsApp to double your bitcoin",
+		"sub4sub anyone? I always sub back",
+		"Earn money from home, contact my manager on telegram",
+	}
+	ham = []string{
+		"Great video, I learned a lot about Go generics today",
+		"Thanks for the clear explanation, the diagram really helped",
+		"What camera do you use? The picture looks amazing",
+		"I tried this recipe yesterday and my family loved it",
+		"The part at 3:20 was the best, please do a follow up",
+		"Could you make a video about error handling next?",
+	}
+)
+
+func trained() *Model {
+	m := New()
+	for _, s := range spam {
+		m.Train(s, Spam)
+	}
+	for _, h := range ham {
+		m.Train(h, Ham)
+	}
+	return m
+}
+
+func TestClassify(t *testing.T) {
+	m := trained()
+	ctx := context.Background()
+
+	tests := []struct {
+		text string
+		spam bool
+	}{
+		{"DM me on telegram for a free crypto giveaway", true},
+		{"double your money with my trading bot, link in bio", true},
+		{"Great explanation, could you make a video about generics?", false},
+		{"Thanks, the recipe video really helped my family", false},
+	}
+	for _, tt := range tests {
+		p, err := m.Classify(ctx, tt.text)
+		if err != nil {
+			t.Fatalf("Classify(%q): %v", tt.text, err)
+		}
+		if (p > 0.5) != tt.spam {
+			t.Errorf("Classify(%q) = %.3f, want spam = %v", tt.text, p, tt.spam)
+		}
+	}
+}
+
+func TestUntrained(t *testing.T) {
+	m := New()
+	m.Train(spam[0], Spam)
+	if _, err := m.Classify(context.Background(), "anything"); !errors.Is(err, ErrUntrained) {
+		t.Errorf("Classify with spam only: err = %v, want ErrUntrained", err)
+	}
+}
+
+func TestForget(t *testing.T) {
+	m := trained()
+	before, _ := m.Classify(context.Background(), ham[0])
+
+	// A moderator overrides a wrong label: forgetting it must restore
+	// the model exactly
+	m.Train(ham[0], Spam)
+	m.Forget(ham[0], Spam)
+	after, _ := m.Classify(context.Background(), ham[0])
+	if before != after {
+		t.Errorf("Classify after Train+Forget = %v, want %v", after, before)
+	}
+	if !reflect.DeepEqual(m, trained()) {
+		t.Errorf("model after Train+Forget differs from the original")
+	}
+
+	// Forgetting what was never trained does not go negative
+	m.Forget("never seen before", Ham)
+	if s, h := m.Docs(); s != len(spam) || h != len(ham)-1 {
+		t.Errorf("Docs() = %d, %d; want %d, %d", s, h, len(spam), len(ham)-1)
+	}
+	for l, n := range m.totals {
+		if n < 0 {
+			t.Errorf("total of %s = %d", l, n)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	m := trained()
+	path := filepath.Join(t.TempDir(), "model.json")
+	if err := m.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, m) {
+		t.Errorf("loaded model differs from the saved one")
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Load of a missing file: expected error")
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	got := Features("Ｆree BTC!")
+	want := []string{
+		"w:free", "c: fr", "c:fre", "c:ree", "c:ee ", "c: fre", "c:free", "c:ree ",
+		"w:btc", "b:free btc", "c: bt", "c:btc", "c:tc ", "c: btc", "c:btc ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Features = %q, want %q", got, want)
+	}
+}
+
+func TestParseLabel(t *testing.T) {
+	for s, want := range map[string]Label{"spam": Spam, " HAM ": Ham} {
+		if got, err := ParseLabel(s); err != nil || got != want {
+			t.Errorf("ParseLabel(%q) = %q, %v; want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParseLabel("eggs"); err == nil {
+		t.Errorf("ParseLabel(eggs): expected error")
+	}
+}
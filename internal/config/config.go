@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,7 +15,89 @@ type Config struct {
 	ModeRation      string `yaml:"MODE_RATION"`
 	LogDir          string `yaml:"LOG_DIR"`
 	CredentialsFile string `yaml:"CREDENTIALS_FILE"`
+	StateFile       string `yaml:"STATE_FILE"`        // where the progress of the scan is kept
 	BannedWordsFile string `yaml:"BANNED_WORDS_FILE"` // optional, default fallback
+	RulesFile       string `yaml:"RULES_FILE"`        // optional, YAML or JSON rules
+	AllowlistFile   string `yaml:"ALLOWLIST_FILE"`    // optional, phrases that cancel banned hits
+
+	// LanguageKeywordFiles maps language codes ("es") to keyword lists
+	// that only apply to comments detected to be in that language
+	LanguageKeywordFiles map[string]string `yaml:"LANGUAGE_KEYWORD_FILES"`
+
+	// HoldScore and RejectScore enable weighted scoring: a comment is
+	// held or rejected once the weights of its keywords add up to them
+	HoldScore   float64 `yaml:"HOLD_SCORE"`
+	RejectScore float64 `yaml:"REJECT_SCORE"`
+
+	// Links: domains on the allow list are never flagged, domains on the
+	// deny list (and URL shorteners and invites, with
+	// DenyShortenersAndInvites) are hits for a rule with
+	// DeniedDomainAction. NonSubscriberLinkAction, if set, applies to
+	// comments from non-subscribers with links that are not allowed.
+	AllowedDomains           []string `yaml:"ALLOWED_DOMAINS"`
+	DeniedDomains            []string `yaml:"DENIED_DOMAINS"`
+	DenyShortenersAndInvites bool     `yaml:"DENY_SHORTENERS_AND_INVITES"`
+	DeniedDomainAction       string   `yaml:"DENIED_DOMAIN_ACTION"`
+	NonSubscriberLinkAction  string   `yaml:"NON_SUBSCRIBER_LINK_ACTION"`
+
+	// Spam waves: DuplicateThreshold near-identical comments (at least
+	// DuplicateMinLength letters long) within DuplicateWindow are all
+	// moderated with DuplicateAction. A zero threshold disables it.
+	DuplicateThreshold int           `yaml:"DUPLICATE_THRESHOLD"`
+	DuplicateWindow    time.Duration `yaml:"DUPLICATE_WINDOW"`
+	DuplicateMinLength int           `yaml:"DUPLICATE_MIN_LENGTH"`
+	DuplicateAction    string        `yaml:"DUPLICATE_ACTION"`
+
+	// Impersonation: words that look like one of ProtectedTerms (the
+	// channel's name, sponsors...) but are written with look-alike
+	// characters are hits for a rule with ImpersonationAction.
+	ProtectedTerms      []string `yaml:"PROTECTED_TERMS"`
+	ImpersonationAction string   `yaml:"IMPERSONATION_ACTION"`
+
+	// Classifier: ClassifierModel is a model trained with "tubeguardian
+	// train". Comments it finds at least ClassifierHold (or
+	// ClassifierReject) likely to be spam are held (or rejected). It
+	// keeps learning from how moderators review held comments.
+	ClassifierModel  string  `yaml:"CLASSIFIER_MODEL"`
+	ClassifierHold   float64 `yaml:"CLASSIFIER_HOLD"`
+	ClassifierReject float64 `yaml:"CLASSIFIER_REJECT"`
+
+	// ExternalClassifier, if set, sends every comment to another
+	// program for a score and labels, see filter.External
+	ExternalClassifier *ExternalClassifier `yaml:"EXTERNAL_CLASSIFIER"`
+
+	// PollInterval is how often new comments are fetched, 5 minutes by
+	// default
+	PollInterval time.Duration `yaml:"POLL_INTERVAL"`
+
+	// ReloadInterval is how often the keyword lists, rules and allowlist
+	// files are checked for changes, 30 seconds by default
+	ReloadInterval time.Duration `yaml:"RELOAD_INTERVAL"`
+
+	// APIEndpoint replaces the address of the YouTube Data API, to run
+	// against a local fake of it (see youtubetest.Server). Requests to
+	// it are not authenticated.
+	APIEndpoint string `yaml:"API_ENDPOINT"`
+
+	// TrustedAuthors lists channel IDs whose comments are never filtered
+	TrustedAuthors []string `yaml:"TRUSTED_AUTHORS"`
+}
+
+// ExternalClassifier configures an external classifier: an HTTP
+// endpoint (URL) or a subprocess speaking JSON lines (Command). Scores
+// reaching Hold or Reject hold or reject the comment, and Labels maps
+// the labels it returns to actions. With Fail "closed", comments are
+// held when it fails or takes longer than Timeout; "open" (the default)
+// lets them through.
+type ExternalClassifier struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"` // sent with every request, e.g. Authorization
+	Command []string          `yaml:"command"`
+	Timeout time.Duration     `yaml:"timeout"` // default 2s
+	Fail    string            `yaml:"fail"`
+	Hold    float64           `yaml:"hold"`
+	Reject  float64           `yaml:"reject"`
+	Labels  map[string]string `yaml:"labels"`
 }
 
 // LoadConfig reads config.yaml into Config struct
@@ -33,6 +116,26 @@ func LoadConfig(path string) (*Config, error) {
 		cfg.BannedWordsFile = "configs/banned_words.txt"
 	}
 
+	if cfg.CredentialsFile == "" {
+		cfg.CredentialsFile = "configs/credentials.json"
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = "configs/state.json"
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Minute
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = 30 * time.Second
+	}
+	if cfg.DuplicateWindow == 0 {
+		cfg.DuplicateWindow = 10 * time.Minute
+	}
+	if cfg.DuplicateMinLength == 0 {
+		cfg.DuplicateMinLength = 20
+	}
+
 	// Setup logging
 	if err := setupLogging(cfg.LogDir); err != nil {
 		return nil, err
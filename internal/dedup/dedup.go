@@ -0,0 +1,173 @@
+// Package dedup detects waves of identical or near-identical comments,
+// as posted by bots across many videos within minutes.
+//
+// Every comment gets a 64-bit SimHash signature computed from the
+// character shingles of its normalized text. Comments that differ by a
+// few characters ("Check my channel!!" and "check my channel 🔥") get
+// signatures that differ by a few bits, so near duplicates are found by
+// comparing signatures by Hamming distance.
+package dedup
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+	"github.com/joshkleinlab/tubeguardian/internal/filter"
+)
+
+const (
+	// shingleSize is the length of the character shingles, in runes
+	shingleSize = 3
+
+	// DefaultDistance is the largest Hamming distance between the
+	// signatures of two comments that are considered near duplicates
+	DefaultDistance = 10
+)
+
+// Detector keeps the signatures of the comments posted within a sliding
+// window and reports clusters of near duplicates. Comments may be added
+// out of order: polls send the replies of a thread, which may be newer
+// than the next thread, right after it, and a backfill reads comments
+// newest first. A comment is only compared with those posted within the
+// window of it. It is not safe for concurrent use.
+type Detector struct {
+	Window    time.Duration // how long a comment is remembered
+	Threshold int           // comments a cluster needs to be a wave
+	MinLength int           // shorter comments (in runes) are ignored
+	Distance  int           // see DefaultDistance
+
+	entries []entry   // in the order they were added
+	newest  time.Time // latest time a comment was posted at
+}
+
+// entry is a remembered comment
+type entry struct {
+	id      string
+	sig     uint64
+	at      time.Time
+	flagged bool
+}
+
+// New creates a Detector that reports clusters of at least threshold
+// near-identical comments posted within window
+func New(window time.Duration, threshold, minLength int) *Detector {
+	return &Detector{Window: window, Threshold: threshold, MinLength: minLength, Distance: DefaultDistance}
+}
+
+// Add records a comment posted at the given time and returns the IDs
+// of the comments that should now be flagged: when the comment's
+// cluster reaches the threshold, all its members that were not flagged
+// before, and once it has, the comment itself.
+func (d *Detector) Add(id, text string, at time.Time) []string {
+	d.expire(at)
+
+	key := Key(text)
+	if len([]rune(key)) < d.MinLength {
+		return nil
+	}
+	sig := Signature(key)
+
+	var members []int
+	for i, e := range d.entries {
+		if at.Sub(e.at).Abs() <= d.Window && bits.OnesCount64(e.sig^sig) <= d.Distance {
+			members = append(members, i)
+		}
+	}
+	d.entries = append(d.entries, entry{id: id, sig: sig, at: at})
+	members = append(members, len(d.entries)-1)
+
+	if len(members) < d.Threshold {
+		return nil
+	}
+	var flagged []string
+	for _, i := range members {
+		if !d.entries[i].flagged {
+			d.entries[i].flagged = true
+			flagged = append(flagged, d.entries[i].id)
+		}
+	}
+	return flagged
+}
+
+// expire forgets the comments posted more than the window before the
+// newest one, unless they are within the window of at, the time of the
+// comment being added: a backfill keeps the comments close to the ones
+// it reads
+func (d *Detector) expire(at time.Time) {
+	if at.After(d.newest) {
+		d.newest = at
+	}
+	cutoff := d.newest.Add(-d.Window)
+	d.entries = slices.DeleteFunc(d.entries, func(e entry) bool {
+		return e.at.Before(cutoff) && at.Sub(e.at).Abs() > d.Window
+	})
+}
+
+// Key reduces a comment to the text its signature is computed from:
+// normalized and case folded, with only letters, digits and single
+// spaces, so that punctuation, emoji and spacing tricks do not matter
+func Key(text string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range filter.Normalize(text).Text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(ahocorasick.FoldRune(r))
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// Signature returns the SimHash of key over its character shingles
+func Signature(key string) uint64 {
+	runes := []rune(key)
+	if len(runes) < shingleSize {
+		return hash(key)
+	}
+
+	var weights [64]int
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		h := hash(string(runes[i : i+shingleSize]))
+		for b := 0; b < 64; b++ {
+			if h&(1<<b) != 0 {
+				weights[b]++
+			} else {
+				weights[b]--
+			}
+		}
+	}
+
+	var sig uint64
+	for b, w := range weights {
+		if w > 0 {
+			sig |= 1 << b
+		}
+	}
+	return sig
+}
+
+// hash is the 64-bit FNV-1a hash of s, with its bits mixed so that
+// similar shingles do not set similar bits
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
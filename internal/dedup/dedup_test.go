@@ -0,0 +1,156 @@
+package dedup
+
+import (
+	"fmt"
+	"math/bits"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Check   MY channel!!! 🔥🔥", "check my channel"},
+		{"ｃｈｅｃｋ my c.h.a.n.n.e.l", "check my c h a n n e l"},
+		{"  ...  ", ""},
+	}
+	for _, tt := range tests {
+		if got := Key(tt.text); got != tt.want {
+			t.Errorf("Key(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSignatureDistance(t *testing.T) {
+	base := Signature(Key("Check out my channel for free crypto giveaways every day!!"))
+	near := []string{
+		"check out my channel for free crypto giveaways every day 🔥🔥",
+		"CHECK OUT MY CHANNEL FOR FREE CRYPTO GIVEAWAYS EVERY DAY",
+		"Check out my chanel for free crypto giveaways everyday!",
+		"Check out my channel for free crypto giveaways every week!!",
+	}
+	far := []string{
+		"Check out my channel for daily videos about cooking",
+		"Thanks for the video, really helpful explanation!",
+		"Great video, I learned a lot about Go generics today",
+	}
+	for _, text := range near {
+		if d := bits.OnesCount64(base ^ Signature(Key(text))); d > DefaultDistance {
+			t.Errorf("%q is %d bits away, want at most %d", text, d, DefaultDistance)
+		}
+	}
+	for _, text := range far {
+		if d := bits.OnesCount64(base ^ Signature(Key(text))); d <= DefaultDistance {
+			t.Errorf("%q is %d bits away, want more than %d", text, d, DefaultDistance)
+		}
+	}
+}
+
+func TestDetector(t *testing.T) {
+	d := New(10*time.Minute, 3, 20)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	add := func(id, text string, after time.Duration) []string {
+		return d.Add(id, text, now.Add(after))
+	}
+
+	if got := add("a", "Check out my channel for free crypto giveaways!!", 0); got != nil {
+		t.Errorf("first comment flagged: %v", got)
+	}
+	if got := add("x", "Great video, I learned a lot about Go generics today", time.Minute); got != nil {
+		t.Errorf("unrelated comment flagged: %v", got)
+	}
+	if got := add("b", "check out my channel for free crypto giveaways 🔥", 2*time.Minute); got != nil {
+		t.Errorf("second comment flagged: %v", got)
+	}
+	if got := add("short", "ok", 2*time.Minute); got != nil {
+		t.Errorf("short comment flagged: %v", got)
+	}
+
+	// The third near duplicate completes the wave: all members are flagged
+	got := add("c", "CHECK OUT MY CHANNEL FOR FREE CRYPTO GIVEAWAYS", 3*time.Minute)
+	if !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("wave = %v, want [a b c]", got)
+	}
+	// Later members are flagged one by one
+	got = add("d", "Check out my channel for free crypto giveaways!!!", 4*time.Minute)
+	if !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("late member = %v, want [d]", got)
+	}
+
+	// Once the wave has left the window, it has to build up again
+	if got := add("e", "Check out my channel for free crypto giveaways!!", 20*time.Minute); got != nil {
+		t.Errorf("comment after the window flagged: %v", got)
+	}
+}
+
+func TestDetectorBackfill(t *testing.T) {
+	d := New(10*time.Minute, 3, 20)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	text := "Check out my channel for free crypto giveaways!!"
+
+	// Read newest first, the same text posted days apart is no wave
+	for i, id := range []string{"a", "b", "c", "d"} {
+		if got := d.Add(id, text, now.Add(-time.Duration(i)*24*time.Hour)); got != nil {
+			t.Errorf("copy %s posted a day apart flagged: %v", id, got)
+		}
+	}
+
+	// but copies posted minutes apart still are
+	var got []string
+	for i, id := range []string{"x", "y", "z"} {
+		got = d.Add(id, text, now.Add(-10*24*time.Hour-time.Duration(i)*time.Minute))
+	}
+	if !reflect.DeepEqual(got, []string{"x", "y", "z"}) {
+		t.Errorf("wave = %v, want [x y z]", got)
+	}
+}
+
+func TestDetectorOutOfOrder(t *testing.T) {
+	d := New(10*time.Minute, 3, 20)
+	at := func(h, m int) time.Time { return time.Date(2025, 1, 1, h, m, 0, 0, time.UTC) }
+	spam := "Check out my channel for free crypto giveaways!!"
+
+	// A poll sends every thread with its replies, which may be newer
+	// than the next thread
+	comments := []struct {
+		id   string
+		text string
+		at   time.Time
+	}{
+		{"t1", "What a great video, thanks for making it", at(12, 0)},
+		{"r1", spam, at(12, 30)},
+		{"r2", spam, at(12, 31)},
+		{"t2", "I learned so much from this one, subscribed", at(12, 5)},
+		{"r3", spam, at(12, 32)},
+	}
+	var got []string
+	for _, c := range comments {
+		got = d.Add(c.id, c.text, c.at)
+	}
+	if !reflect.DeepEqual(got, []string{"r1", "r2", "r3"}) {
+		t.Errorf("wave = %v, want [r1 r2 r3]", got)
+	}
+
+	// Comments long before the newest are forgotten
+	d.Add("late", "A late comment that is long enough to be kept", at(14, 0))
+	if len(d.entries) != 1 {
+		t.Errorf("%d comments remembered, want 1", len(d.entries))
+	}
+}
+
+// BenchmarkDetectorAdd adds a comment per second with a 10 minute
+// window, so about 600 comments are compared each time
+func BenchmarkDetectorAdd(b *testing.B) {
+	d := New(10*time.Minute, 50, 20)
+	texts := make([]string, 1000)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("Comment number %d about something entirely different each time", i)
+	}
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Add(fmt.Sprint(i), texts[i%len(texts)], now.Add(time.Duration(i)*time.Second))
+	}
+}
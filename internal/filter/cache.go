@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// cacheMagic starts every automaton cache file
+var cacheMagic = []byte("tubeguardian automata 1\n")
+
+// automatonCache keeps compiled automata in a file next to a keyword
+// list, so that a restart does not compile a large list again. Each
+// automaton is stored under the SHA-256 of the patterns it was compiled
+// from: when the list changes, its patterns hash differently and the
+// automaton is compiled again. The whole file is covered by a checksum,
+// and a file that fails it is ignored.
+type automatonCache struct {
+	path    string
+	stored  map[[sha256.Size]byte][]byte // entries read from the file
+	current map[[sha256.Size]byte][]byte // entries used by this load
+}
+
+// openCache reads the cache file at path. A missing or damaged file
+// gives an empty cache.
+func openCache(path string) *automatonCache {
+	c := &automatonCache{
+		path:    path,
+		stored:  make(map[[sha256.Size]byte][]byte),
+		current: make(map[[sha256.Size]byte][]byte),
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		c.stored, err = decodeCache(data)
+	}
+	if err != nil {
+		c.stored = make(map[[sha256.Size]byte][]byte)
+	}
+	return c
+}
+
+// compile returns a case folding automaton for patterns, loading it from
+// the cache when an entry for the same patterns exists
+func (c *automatonCache) compile(patterns []string) ahocorasick.Automaton {
+	key := patternsHash(patterns)
+
+	if data, ok := c.stored[key]; ok {
+		m := new(ahocorasick.CompactMatcher)
+		if err := m.UnmarshalBinary(data); err == nil {
+			c.current[key] = data
+			return m
+		}
+	}
+
+	m := ahocorasick.NewCompactFoldingMatcher(patterns)
+	if data, err := m.MarshalBinary(); err == nil {
+		c.current[key] = data
+	}
+	return m
+}
+
+// save writes the automata used by this load back to the file, dropping
+// entries for patterns that are no longer in use. Nothing is written if
+// the file already holds exactly these entries.
+func (c *automatonCache) save() error {
+	if len(c.current) == len(c.stored) {
+		same := true
+		for key := range c.current {
+			if _, ok := c.stored[key]; !ok {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(encodeCache(c.current)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+
+	c.stored = c.current
+	return nil
+}
+
+// patternsHash identifies a pattern list
+func patternsHash(patterns []string) [sha256.Size]byte {
+	h := sha256.New()
+	var n [binary.MaxVarintLen64]byte
+	for _, p := range patterns {
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(p)))])
+		h.Write([]byte(p))
+	}
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// encodeCache lays out a cache file: the magic, then for every entry its
+// key, length and data, then a SHA-256 of everything before it
+func encodeCache(entries map[[sha256.Size]byte][]byte) []byte {
+	keys := make([][sha256.Size]byte, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+
+	buf := append([]byte(nil), cacheMagic...)
+	for _, key := range keys {
+		buf = append(buf, key[:]...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(entries[key])))
+		buf = append(buf, entries[key]...)
+	}
+	sum := sha256.Sum256(buf)
+	return append(buf, sum[:]...)
+}
+
+// decodeCache parses a cache file written by encodeCache
+func decodeCache(data []byte) (map[[sha256.Size]byte][]byte, error) {
+	errBad := errors.New("damaged automaton cache")
+
+	if len(data) < len(cacheMagic)+sha256.Size || !bytes.HasPrefix(data, cacheMagic) {
+		return nil, errBad
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if want := sha256.Sum256(body); !bytes.Equal(sum, want[:]) {
+		return nil, errBad
+	}
+
+	entries := make(map[[sha256.Size]byte][]byte)
+	body = body[len(cacheMagic):]
+	for len(body) > 0 {
+		if len(body) < sha256.Size+8 {
+			return nil, errBad
+		}
+		var key [sha256.Size]byte
+		copy(key[:], body)
+		n := binary.LittleEndian.Uint64(body[sha256.Size:])
+		body = body[sha256.Size+8:]
+		if n > uint64(len(body)) {
+			return nil, errBad
+		}
+		entries[key] = body[:n]
+		body = body[n:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// leet maps digits and symbols commonly used in place of letters
+var leet = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'l', '+': 't', '€': 'e', '£': 'l',
+}
+
+// leetInWord are the leet substitutions that are just as often
+// punctuation or numbers, mapped only inside a word: "g1ft" but not
+// "scam!" or "1 gift"
+var leetInWord = map[rune]bool{'1': true, '!': true, '|': true}
+
+// Canonical returns a coarser form of already normalized text that is
+// tolerant of leetspeak and padding: leet substitutions are mapped back
+// to letters ("g1ft" → "gift", but "1", "!" and "|" only between
+// letters or digits), punctuation and symbols are removed
+// ("s.c.a.m" → "scam") and runs of the same letter, in any case, are
+// collapsed to one ("freeeEE moneyyy" → "fre money"). Because runs are
+// collapsed, keywords must go through Canonical too before they are
+// compared with canonical text.
+//
+// Offsets in the result still map to the original text.
+func (n Normalized) Canonical() Normalized {
+	var b strings.Builder
+	b.Grow(len(n.Text))
+	src := make([]int, 0, len(n.Text))
+
+	prev := rune(-1)
+	for i := 0; i < len(n.Text); {
+		r, size := utf8.DecodeRuneInString(n.Text[i:])
+		if l, ok := leet[r]; ok && (!leetInWord[r] || inWord(n.Text, i, size)) {
+			r = l
+		}
+
+		switch {
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			// dropped, but does not break a run: "fr-ee" → "fre"
+		case ahocorasick.FoldRune(r) == prev:
+			// repeated
+		default:
+			prev = ahocorasick.FoldRune(r)
+			at := b.Len()
+			b.WriteRune(r)
+			for j := at; j < b.Len(); j++ {
+				src = append(src, n.src[i])
+			}
+		}
+		i += size
+	}
+
+	return Normalized{Text: b.String(), original: n.original, src: src}
+}
+
+// inWord reports whether the rune at text[i:i+size] has a letter or digit
+// on both sides
+func inWord(text string, i, size int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[i+size:])
+	isAlnum := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	return isAlnum(before) && isAlnum(after)
+}
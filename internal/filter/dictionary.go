@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// dictionary is an Aho-Corasick automaton over the patterns of a set of
+// keywords. The automaton reports one dictionary index per pattern, so
+// the same phrase declared twice (e.g. with different modes) is added
+// once and owned by several keywords. Matching ignores case.
+//
+// The compact automaton is used because keyword lists can grow to tens
+// of thousands of phrases, where the dense one costs hundreds of MB.
+type dictionary struct {
+	ac     ahocorasick.Automaton
+	owners [][]int // keyword indexes for each automaton pattern
+}
+
+// newDictionary builds a dictionary from the keywords for which include
+// returns true, using form to turn each keyword into its pattern. The
+// automaton is taken from cache if it is not nil. It returns nil if no
+// keyword is included.
+func newDictionary(keywords []Keyword, include func(Keyword) bool, form func(string) string, cache *automatonCache) *dictionary {
+	var patterns []string
+	var owners [][]int
+	index := make(map[string]int)
+	for i, kw := range keywords {
+		if !include(kw) {
+			continue
+		}
+		pattern := ahocorasick.Fold(form(kw.Text))
+		p, ok := index[pattern]
+		if !ok {
+			p = len(patterns)
+			index[pattern] = p
+			patterns = append(patterns, pattern)
+			owners = append(owners, nil)
+		}
+		owners[p] = append(owners[p], i)
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	d := &dictionary{owners: owners}
+	if cache != nil {
+		d.ac = cache.compile(patterns)
+	} else {
+		d.ac = ahocorasick.NewCompactFoldingMatcher(patterns)
+	}
+	return d
+}
+
+// find scans text for the dictionary's patterns and returns a hit for
+// every occurrence accepted by one of the owning keywords. A phrase
+// shared by several rules gives one hit per rule, so that each of them
+// is considered when deciding what to do with the comment.
+func (d *dictionary) find(text Normalized, keywords []Keyword) []Hit {
+	var hits []Hit
+	for _, h := range d.ac.MatchPositions([]byte(text.Text)) {
+		first := len(hits)
+		for _, k := range d.owners[h.Index] {
+			kw := keywords[k]
+			if !kw.accepts(text.Text, h.Start, h.End) || hasRule(hits[first:], kw.Rule) {
+				continue
+			}
+			start, end := text.Span(h.Start, h.End)
+			hits = append(hits, Hit{
+				Word:   kw.Text,
+				Start:  start,
+				End:    end,
+				Rule:   kw.Rule,
+				Weight: kw.weight(),
+			})
+		}
+	}
+	return hits
+}
+
+// hasRule reports whether one of hits belongs to r
+func hasRule(hits []Hit, r *Rule) bool {
+	for _, h := range hits {
+		if h.Rule == r {
+			return true
+		}
+	}
+	return false
+}
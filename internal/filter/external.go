@@ -0,0 +1,250 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/config"
+)
+
+// defaultExternalTimeout bounds a call to an external classifier that
+// does not set a timeout
+const defaultExternalTimeout = 2 * time.Second
+
+// ExternalComment is what an external classifier receives, as JSON
+type ExternalComment struct {
+	ID                string    `json:"id"`
+	Text              string    `json:"text"`
+	AuthorChannelID   string    `json:"author_channel_id,omitempty"`
+	AuthorDisplayName string    `json:"author_display_name,omitempty"`
+	VideoID           string    `json:"video_id,omitempty"`
+	ParentID          string    `json:"parent_id,omitempty"`
+	PublishedAt       time.Time `json:"published_at,omitzero"`
+}
+
+// ExternalResult is what an external classifier answers, as JSON:
+// {"score": 0.93, "labels": ["toxic", "insult"]}
+type ExternalResult struct {
+	Score  float64  `json:"score"`
+	Labels []string `json:"labels"`
+}
+
+// External is a classifier stage run by another program: either an HTTP
+// endpoint that receives an ExternalComment in a POST and answers with an
+// ExternalResult, or a long-running subprocess that reads one comment per
+// line on stdin and writes one result per line on stdout, in order.
+type External struct {
+	url        string
+	headers    map[string]string
+	client     *http.Client
+	proc       *externalProcess // nil for HTTP
+	timeout    time.Duration
+	hold       float64
+	reject     float64
+	labels     map[string]Action
+	failAction Action // action when the classifier fails, "" to fail open
+}
+
+// NewExternal sets up the external classifier described by cfg
+func NewExternal(cfg *config.ExternalClassifier) (*External, error) {
+	if (cfg.URL == "") == (len(cfg.Command) == 0) {
+		return nil, errors.New("EXTERNAL_CLASSIFIER: set either url or command")
+	}
+
+	e := &External{
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		client:  &http.Client{},
+		timeout: cfg.Timeout,
+		hold:    cfg.Hold,
+		reject:  cfg.Reject,
+		labels:  make(map[string]Action),
+	}
+	if e.timeout <= 0 {
+		e.timeout = defaultExternalTimeout
+	}
+	if len(cfg.Command) > 0 {
+		e.proc = &externalProcess{command: cfg.Command}
+	}
+
+	switch cfg.Fail {
+	case "", "open":
+	case "closed":
+		e.failAction = ActionHold
+	default:
+		return nil, fmt.Errorf("EXTERNAL_CLASSIFIER: fail must be open or closed, not %q", cfg.Fail)
+	}
+	for label, a := range cfg.Labels {
+		action, err := ParseAction(a)
+		if err != nil {
+			return nil, fmt.Errorf("EXTERNAL_CLASSIFIER: label %q: %w", label, err)
+		}
+		e.labels[label] = action
+	}
+	return e, nil
+}
+
+// Check sends a comment to the external classifier and returns its
+// answer with the action it calls for: reject or hold when the score
+// reaches the thresholds, or the harsher action of the labels it gave.
+// If the classifier fails or times out, the action is that of the fail
+// mode (hold when failing closed, none when failing open) and the error
+// is returned too.
+func (e *External) Check(ctx context.Context, c ExternalComment) (Action, ExternalResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	var res ExternalResult
+	req, err := json.Marshal(c)
+	if err == nil {
+		var resp []byte
+		if e.proc != nil {
+			resp, err = e.proc.call(ctx, req)
+		} else {
+			resp, err = e.post(ctx, req)
+		}
+		if err == nil {
+			err = json.Unmarshal(resp, &res)
+		}
+	}
+	if err != nil {
+		return e.failAction, res, fmt.Errorf("external classifier: %w", err)
+	}
+
+	var action Action
+	switch {
+	case e.reject > 0 && res.Score >= e.reject:
+		action = ActionReject
+	case e.hold > 0 && res.Score >= e.hold:
+		action = ActionHold
+	}
+	for _, l := range res.Labels {
+		action = Harsher(action, e.labels[l])
+	}
+	return action, res, nil
+}
+
+// post sends a request to the HTTP endpoint and returns the response body
+func (e *External) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", e.url, resp.Status)
+	}
+	return data, nil
+}
+
+// Close stops the subprocess of the classifier, if any
+func (e *External) Close() error {
+	if e.proc != nil {
+		e.proc.mu.Lock()
+		defer e.proc.mu.Unlock()
+		e.proc.stop()
+	}
+	return nil
+}
+
+// externalProcess is a subprocess speaking line-delimited JSON. It is
+// started on the first call and restarted after it fails or times out,
+// since a late answer would otherwise be read as the next one.
+type externalProcess struct {
+	mu      sync.Mutex
+	command []string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+}
+
+// call writes a request line and reads the answer line
+func (p *externalProcess) call(ctx context.Context, req []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	stdin, stdout := p.stdin, p.stdout
+	go func() {
+		if _, err := stdin.Write(append(req, '\n')); err != nil {
+			done <- result{err: err}
+			return
+		}
+		line, err := stdout.ReadBytes('\n')
+		done <- result{line: line, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			p.stop()
+		}
+		return r.line, r.err
+	case <-ctx.Done():
+		p.stop()
+		return nil, ctx.Err()
+	}
+}
+
+// start starts the subprocess. Its stderr goes to the log.
+func (p *externalProcess) start() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = log.Writer()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %v: %w", p.command, err)
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stop kills the subprocess, if it runs
+func (p *externalProcess) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.cmd = nil
+}
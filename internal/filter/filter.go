@@ -2,52 +2,512 @@ package filter
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"os"
+	"slices"
+	"sort"
 	"strings"
 
-	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+	"github.com/joshkleinlab/tubeguardian/internal/config"
 )
 
-// Matcher holds the Aho-Corasick automaton for banned words
+// Matcher holds the Aho-Corasick automata for banned words
 type Matcher struct {
-	ac    *ahocorasick.Matcher
-	words []string
+	keywords      []Keyword
+	plain         *dictionary     // keywords matched against normalized text
+	leet          *dictionary     // keywords matched against canonical text
+	fuzzy         *fuzzyIndex     // fuzzy keywords matched against normalized text
+	fuzzyLeet     *fuzzyIndex     // fuzzy keywords matched against canonical text
+	regex         *regexSet       // regular expressions of rules
+	defaultAction Action          // action of rules that do not set one
+	scorer        *Scorer         // decides for rules without an action, if set
+	links         *linkPolicy     // link checks, if set
+	linkAction    Action          // action for links from non-subscribers, if set
+	protected     *protectedTerms // impersonation checks, if set
+	heuristics    *Heuristics     // heuristics of the rules file, if set
+	signalRules   []*Rule         // rules with signals
+	languages     bool            // whether some rules are restricted to languages
 }
 
-// LoadKeywords loads keywords from a file into a Matcher
+// Hit is a banned keyword found in a comment. Start and End are byte
+// offsets into the original (not normalized) comment text.
+type Hit struct {
+	Word     string
+	Start    int
+	End      int
+	Rule     *Rule   // rule the keyword belongs to
+	Distance int     // edit distance of a fuzzy match, 0 for exact matches
+	Weight   float64 // weight of the keyword, see Scorer
+}
+
+// Verdict is the outcome of checking a comment
+type Verdict struct {
+	Hits   []Hit
+	Rule   *Rule  // rule that decided the action, nil if none or the score did
+	Action Action // action to take, empty if none
+	Score  *Score // score of the hits, nil unless scoring is enabled
+
+	// Links lists the links to domains that are not allowed, and
+	// LinkAction is what to do with the comment if its author is not a
+	// subscriber (empty if nothing)
+	Links      []Link
+	LinkAction Action
+
+	// Signals lists the heuristics the comment raised
+	Signals []Signal
+
+	// Language is the language of the comment, if it had to be detected
+	// for rules restricted to languages, "" otherwise
+	Language string
+}
+
+// defaultRule is the rule of keywords from the plain keyword list
+var defaultRule = &Rule{Name: "banned_words", Category: "default", Severity: SeverityMedium}
+
+// allowRule marks keywords from the allowlist. Their hits are never
+// reported; they cancel the banned hits they overlap.
+var allowRule = &Rule{Name: "allowlist", Category: "allow"}
+
+// Load builds a Matcher from the keyword lists, the rules file and the
+// allowlist named in cfg. Keywords from the plain list form a single
+// default rule whose action is cfg.ModeRation, and so do those of each
+// per-language list, for comments in its language. When a rules file
+// is set, the plain list is optional, and heuristics configured in the
+// rules file are applied. If cfg sets score thresholds, the score
+// decides instead of rules without an action. Links are checked against
+// the domain lists of cfg, and imitations of the protected terms of cfg
+// are reported as impersonation.
+func Load(cfg *config.Config) (*Matcher, error) {
+	action := ActionHold
+	if cfg.ModeRation != "" {
+		var err error
+		if action, err = ParseAction(cfg.ModeRation); err != nil {
+			return nil, fmt.Errorf("MODE_RATION: %w", err)
+		}
+	}
+
+	var regexes []regexPattern
+	var heuristics *Heuristics
+	var signalRules []*Rule
+	languages := false
+	keywords, err := readKeywords(cfg.BannedWordsFile)
+	if err != nil && !(errors.Is(err, fs.ErrNotExist) && cfg.RulesFile != "") {
+		return nil, err
+	}
+
+	langs := make([]string, 0, len(cfg.LanguageKeywordFiles))
+	for lang := range cfg.LanguageKeywordFiles {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		if !knownLanguage(lang) {
+			return nil, fmt.Errorf("LANGUAGE_KEYWORD_FILES: unknown language %q (known: %s)", lang, strings.Join(Languages(), ", "))
+		}
+		kws, err := readKeywords(cfg.LanguageKeywordFiles[lang])
+		if err != nil {
+			return nil, err
+		}
+		rule := &Rule{Name: defaultRule.Name + "_" + lang, Category: defaultRule.Category, Severity: defaultRule.Severity,
+			Languages: []string{lang}}
+		for _, kw := range kws {
+			kw.Rule = rule
+			keywords = append(keywords, kw)
+		}
+		languages = true
+	}
+
+	if cfg.RulesFile != "" {
+		f, err := loadRuleFile(cfg.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		if f.Heuristics != (Heuristics{}) {
+			heuristics = &f.Heuristics
+		}
+		rules := f.Rules
+		for i := range rules {
+			if len(rules[i].Signals) > 0 {
+				signalRules = append(signalRules, &rules[i])
+			}
+			if len(rules[i].Languages) > 0 {
+				languages = true
+			}
+
+			kws, err := ruleKeywords(&rules[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", cfg.RulesFile, err)
+			}
+			keywords = append(keywords, kws...)
+
+			res, err := ruleRegexes(&rules[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", cfg.RulesFile, err)
+			}
+			regexes = append(regexes, res...)
+		}
+	}
+
+	if cfg.AllowlistFile != "" {
+		allowed, err := readKeywords(cfg.AllowlistFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, kw := range allowed {
+			kw.Rule = allowRule
+			keywords = append(keywords, kw)
+		}
+	}
+
+	m := compile(keywords, cfg.BannedWordsFile+".cache")
+	m.regex = newRegexSet(regexes)
+	m.heuristics, m.signalRules = heuristics, signalRules
+	m.languages = languages
+	m.defaultAction = action
+	if cfg.HoldScore > 0 || cfg.RejectScore > 0 {
+		m.scorer = &Scorer{Hold: cfg.HoldScore, Reject: cfg.RejectScore}
+	}
+
+	var deniedAction Action
+	if cfg.DeniedDomainAction != "" {
+		if deniedAction, err = ParseAction(cfg.DeniedDomainAction); err != nil {
+			return nil, fmt.Errorf("DENIED_DOMAIN_ACTION: %w", err)
+		}
+	}
+	if cfg.NonSubscriberLinkAction != "" {
+		if m.linkAction, err = ParseAction(cfg.NonSubscriberLinkAction); err != nil {
+			return nil, fmt.Errorf("NON_SUBSCRIBER_LINK_ACTION: %w", err)
+		}
+	}
+	m.links = newLinkPolicy(cfg.AllowedDomains, cfg.DeniedDomains, cfg.DenyShortenersAndInvites, deniedAction)
+
+	var impersonationAction Action
+	if cfg.ImpersonationAction != "" {
+		if impersonationAction, err = ParseAction(cfg.ImpersonationAction); err != nil {
+			return nil, fmt.Errorf("IMPERSONATION_ACTION: %w", err)
+		}
+	}
+	if len(cfg.ProtectedTerms) > 0 {
+		m.protected = newProtectedTerms(cfg.ProtectedTerms, impersonationAction)
+	}
+	return m, nil
+}
+
+// LoadKeywords loads keywords from a file into a Matcher. Matching
+// comments are held for review.
 func LoadKeywords(path string) (*Matcher, error) {
+	keywords, err := readKeywords(path)
+	if err != nil {
+		return nil, err
+	}
+	return compile(keywords, path+".cache"), nil
+}
+
+// readKeywords parses a plain keyword list, one keyword per line
+func readKeywords(path string) ([]Keyword, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var words []string
+	var keywords []Keyword
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		w := strings.TrimSpace(scanner.Text())
-		if w != "" {
-			words = append(words, w)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
 		}
+		kw, err := ParseKeyword(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keywords = append(keywords, kw)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	return keywords, nil
+}
+
+// compile builds a Matcher, caching the compiled automata in cachePath
+func compile(keywords []Keyword, cachePath string) *Matcher {
+	cache := openCache(cachePath)
+	m := newMatcher(keywords, cache)
+	if err := cache.save(); err != nil {
+		log.Printf("⚠️  Failed to cache compiled keywords: %v", err)
+	}
+	return m
+}
+
+// NewMatcher builds a Matcher from already parsed keywords
+func NewMatcher(keywords []Keyword) *Matcher {
+	return newMatcher(keywords, nil)
+}
+
+// newMatcher builds a Matcher, taking compiled automata from cache if it
+// is not nil. Keywords without a rule are given the default rule.
+func newMatcher(keywords []Keyword, cache *automatonCache) *Matcher {
+	keywords = append([]Keyword(nil), keywords...)
+	for i := range keywords {
+		if keywords[i].Rule == nil {
+			keywords[i].Rule = defaultRule
+		}
+	}
 
-	m := ahocorasick.NewStringMatcher(words)
+	plainForm := func(s string) string { return Normalize(s).Text }
+	leetForm := func(s string) string { return Normalize(s).Canonical().Text }
 	return &Matcher{
-		ac:    m,
-		words: words,
-	}, nil
+		keywords: keywords,
+		plain: newDictionary(keywords,
+			func(kw Keyword) bool { return !kw.Leet && kw.Fuzzy == 0 },
+			plainForm, cache),
+		leet: newDictionary(keywords,
+			func(kw Keyword) bool { return kw.Leet && kw.Fuzzy == 0 },
+			leetForm, cache),
+		fuzzy: newFuzzyIndex(keywords,
+			func(kw Keyword) bool { return !kw.Leet && kw.Fuzzy > 0 },
+			plainForm),
+		fuzzyLeet: newFuzzyIndex(keywords,
+			func(kw Keyword) bool { return kw.Leet && kw.Fuzzy > 0 },
+			leetForm),
+		defaultAction: ActionHold,
+	}
+}
+
+// Check finds the banned keywords in text and decides what to do with
+// it. When keywords of several rules match, the rule with the highest
+// severity wins, and among equally severe rules the one with the
+// harsher action.
+//
+// With a Scorer, rules without an action of their own no longer decide
+// on a single hit. Instead all hits are scored, and the score's action
+// applies if it is harsher than that of the winning rule.
+func (m *Matcher) Check(text string) Verdict {
+	return m.check(text, nil)
+}
+
+// CheckComment is Check for a comment known both as plain text and as
+// the HTML YouTube displays it with: the targets of its <a href> links,
+// which the plain text loses when a link reads "click here", are
+// checked as links too. Offsets into html mean nothing in text, so
+// these links, and the hits for them, have no span (Start == End): they
+// are not highlighted, and allowlisted phrases do not cancel them.
+func (m *Matcher) CheckComment(text, html string) Verdict {
+	hrefs := hrefLinks(html)
+	for i := range hrefs {
+		hrefs[i].Start, hrefs[i].End = 0, 0
+	}
+	return m.check(text, hrefs)
+}
+
+// check implements Check, with hrefs checked along with the links of
+// text
+func (m *Matcher) check(text string, hrefs []Link) Verdict {
+	v := m.find(text, hrefs)
+	if len(v.Links) > 0 {
+		v.LinkAction = m.linkAction
+	}
+	for _, h := range v.Hits {
+		if m.scorer != nil && h.Rule.Action == "" {
+			continue
+		}
+		if v.Rule == nil || outranks(h.Rule, v.Rule, m.defaultAction) {
+			v.Rule = h.Rule
+		}
+	}
+	if v.Rule != nil {
+		v.Action = v.Rule.action(m.defaultAction)
+	}
+
+	if m.scorer != nil && len(v.Hits) > 0 {
+		sc := m.scorer.Score(v.Hits)
+		v.Score = &sc
+		if a := m.scorer.Action(sc); a.strength() > v.Action.strength() {
+			v.Rule, v.Action = nil, a
+		}
+	}
+	return v
 }
 
-// Match finds all banned keywords inside the given text
+// Match finds all banned keywords inside the given text, leaving out
+// those covered by an allowlisted phrase
 func (m *Matcher) Match(text string) []string {
-	matches := m.ac.Match([]byte(strings.ToLower(text)))
+	return Words(m.Find(text))
+}
+
+// Find returns every occurrence of a banned keyword inside the given
+// text, with the position of each occurrence in text. Occurrences that
+// overlap an allowlisted phrase ("scam awareness" for "scam") are left
+// out.
+func (m *Matcher) Find(text string) []Hit {
+	return m.find(text, nil).Hits
+}
+
+// find implements Find. It returns a Verdict with the hits, the links in
+// text (and hrefs) that are not allowed, the signals raised by
+// heuristics and the language of text if it was needed. Links to denied
+// domains, imitated protected terms and rules matched by signals are
+// reported as hits; hits of rules for other languages are dropped.
+func (m *Matcher) find(text string, hrefs []Link) Verdict {
+	norm := Normalize(text)
+
+	var hits []Hit
+	if m.plain != nil {
+		hits = append(hits, m.plain.find(norm, m.keywords)...)
+	}
+	if m.leet != nil || m.fuzzyLeet != nil {
+		canon := norm.Canonical()
+		if m.leet != nil {
+			hits = append(hits, m.leet.find(canon, m.keywords)...)
+		}
+		if m.fuzzyLeet != nil {
+			hits = append(hits, m.fuzzyLeet.find(canon, m.keywords)...)
+		}
+	}
+	if m.fuzzy != nil {
+		hits = append(hits, m.fuzzy.find(norm, m.keywords)...)
+	}
+	if m.regex != nil {
+		hits = append(hits, m.regex.find(norm)...)
+	}
+
+	var links []Link
+	if m.links != nil {
+		found := ExtractLinks(text)
+		for _, h := range hrefs {
+			if !slices.ContainsFunc(found, func(l Link) bool { return l.Host == h.Host && l.Path == h.Path }) {
+				found = append(found, h)
+			}
+		}
+		for _, l := range found {
+			if m.links.allowed(l) {
+				continue
+			}
+			links = append(links, l)
+			if m.links.denied(l) {
+				hits = append(hits, Hit{Word: l.Host, Start: l.Start, End: l.End, Rule: m.links.rule, Weight: m.links.rule.weight()})
+			}
+		}
+	}
+
+	if m.protected != nil {
+		hits = append(hits, m.protected.find(text)...)
+	}
+
+	v := Verdict{Hits: allow(hits), Links: links}
+	if m.heuristics != nil {
+		v.Signals = m.heuristics.Detect(norm)
+		v.Hits = signalHits(v.Hits, m.signalRules, v.Signals)
+	}
+	if m.languages && slices.ContainsFunc(v.Hits, func(h Hit) bool { return len(h.Rule.Languages) > 0 }) {
+		// Only detected when it matters, as it is the slowest step
+		v.Language = DetectLanguage(text)
+		v.Hits = inLanguage(v.Hits, v.Language)
+	}
 
-	var results []string
-	for _, idx := range matches {
-		results = append(results, m.words[idx])
+	if len(v.Hits) > 1 {
+		sort.SliceStable(v.Hits, func(i, j int) bool { return v.Hits[i].Start < v.Hits[j].Start })
+	}
+	return v
+}
+
+// allow removes allowlist hits, and the banned hits they overlap, from
+// hits
+func allow(hits []Hit) []Hit {
+	var allowed []Hit
+	for _, h := range hits {
+		if h.Rule == allowRule {
+			allowed = append(allowed, h)
+		}
+	}
+	if len(allowed) == 0 {
+		return hits
+	}
+
+	kept := hits[:0]
+	for _, h := range hits {
+		if h.Rule != allowRule && !overlapsAny(h, allowed) {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// overlapsAny reports whether h shares at least one byte with any of
+// spans
+func overlapsAny(h Hit, spans []Hit) bool {
+	for _, s := range spans {
+		if h.Start < s.End && s.Start < h.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Words lists the distinct keywords among hits, in order of appearance
+func Words(hits []Hit) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, h := range hits {
+		if !seen[h.Word] {
+			seen[h.Word] = true
+			words = append(words, h.Word)
+		}
+	}
+	return words
+}
+
+// Describe lists the distinct keywords among hits like Words, marking
+// fuzzy matches with their edit distance ("crypto~1"). It is meant for
+// logs.
+func Describe(hits []Hit) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, h := range hits {
+		d := h.Word
+		if h.Distance > 0 {
+			d = fmt.Sprintf("%s~%d", h.Word, h.Distance)
+		}
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// Highlight returns text with every hit wrapped in «», merging hits that
+// overlap. It is meant for logs, so reviewers can see a match in context.
+func Highlight(text string, hits []Hit) string {
+	if len(hits) == 0 {
+		return text
+	}
+
+	marked := make([]bool, len(text))
+	for _, h := range hits {
+		for i := h.Start; i < h.End && i < len(text); i++ {
+			marked[i] = true
+		}
+	}
+
+	var b strings.Builder
+	in := false
+	for i := 0; i < len(text); i++ {
+		if marked[i] != in {
+			if in {
+				b.WriteString("»")
+			} else {
+				b.WriteString("«")
+			}
+			in = marked[i]
+		}
+		b.WriteByte(text[i])
+	}
+	if in {
+		b.WriteString("»")
 	}
-	return results
+	return b.String()
 }
@@ -0,0 +1,1297 @@
+package filter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/config"
+)
+
+func mustMatcher(t *testing.T, lines ...string) *Matcher {
+	t.Helper()
+	var keywords []Keyword
+	for _, l := range lines {
+		kw, err := ParseKeyword(l)
+		if err != nil {
+			t.Fatalf("ParseKeyword(%q): %v", l, err)
+		}
+		keywords = append(keywords, kw)
+	}
+	return NewMatcher(keywords)
+}
+
+// testConfig writes files, by name, to a new temporary directory and
+// points cfg at them: banned_words.txt, rules.yaml or rules.json,
+// allowlist.txt and banned_words.<lang>.txt. BannedWordsFile is set
+// even without its file.
+func testConfig(t *testing.T, cfg config.Config, files map[string]string) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		switch name {
+		case "rules.yaml", "rules.json":
+			cfg.RulesFile = path
+		case "allowlist.txt":
+			cfg.AllowlistFile = path
+		default:
+			if lang, ok := strings.CutPrefix(strings.TrimSuffix(name, ".txt"), "banned_words."); ok {
+				if cfg.LanguageKeywordFiles == nil {
+					cfg.LanguageKeywordFiles = make(map[string]string)
+				}
+				cfg.LanguageKeywordFiles[lang] = path
+			}
+		}
+	}
+	cfg.BannedWordsFile = filepath.Join(dir, "banned_words.txt")
+	return &cfg
+}
+
+// mustLoad loads the matcher of cfg with files, see testConfig, and
+// returns it with the config it was loaded from
+func mustLoad(t *testing.T, cfg config.Config, files map[string]string) (*Matcher, *config.Config) {
+	t.Helper()
+	c := testConfig(t, cfg, files)
+	m, err := Load(c)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return m, c
+}
+
+func TestParseKeyword(t *testing.T) {
+	tests := []struct {
+		line string
+		want Keyword
+	}{
+		{"crypto", Keyword{Text: "crypto"}},
+		{"  free gift  ", Keyword{Text: "free gift"}},
+		{"ass | word", Keyword{Text: "ass", Mode: ModeWord}},
+		{"scam|prefix", Keyword{Text: "scam", Mode: ModePrefix}},
+		{"scam | substring", Keyword{Text: "scam"}},
+		{"crypto | fuzzy", Keyword{Text: "crypto", Mode: ModeWord, Fuzzy: 1}},
+		{"cryptocurrency | fuzzy=2, leet", Keyword{Text: "cryptocurrency", Mode: ModeWord, Leet: true, Fuzzy: 2}},
+		{"free gift | leet", Keyword{Text: "free gift", Mode: ModeWord, Leet: true}},
+		{"free | leet, substring", Keyword{Text: "free", Leet: true}},
+		{"free | prefix, leet", Keyword{Text: "free", Mode: ModePrefix, Leet: true}},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeyword(tt.line)
+		if err != nil {
+			t.Errorf("ParseKeyword(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseKeyword(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"", " | word", "scam | bogus", "scam | fuzzy=0", "scam | fuzzy=x", "scam | prefix, fuzzy"} {
+		if _, err := ParseKeyword(line); err == nil {
+			t.Errorf("ParseKeyword(%q): expected error", line)
+		}
+	}
+}
+
+func TestFindPositions(t *testing.T) {
+	m := mustMatcher(t, "crypto", "scam")
+	text := "Free CRYPTO here, no scam"
+	hits := m.Find(text)
+	if len(hits) != 2 {
+		t.Fatalf("got %d hits, want 2: %+v", len(hits), hits)
+	}
+	if got := text[hits[0].Start:hits[0].End]; got != "CRYPTO" {
+		t.Errorf("first hit spans %q", got)
+	}
+	if got := text[hits[1].Start:hits[1].End]; got != "scam" {
+		t.Errorf("second hit spans %q", got)
+	}
+	if got := Highlight(text, hits); got != "Free «CRYPTO» here, no «scam»" {
+		t.Errorf("Highlight = %q", got)
+	}
+}
+
+func TestMatchModes(t *testing.T) {
+	m := mustMatcher(t, "ass | word", "scam | prefix", "gift")
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"what a class act", nil},
+		{"passion and assistant", nil},
+		{"you ass!", []string{"ass"}},
+		{"ass", []string{"ass"}},
+		{"scammers everywhere", []string{"scam"}},
+		{"antiscam group", nil},
+		{"giftcards", []string{"gift"}},
+		{"ÉLASS ass", []string{"ass"}},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSamePhraseDifferentModes(t *testing.T) {
+	m := mustMatcher(t, "ass | word", "ass | prefix")
+	if got := m.Match("assets"); !reflect.DeepEqual(got, []string{"ass"}) {
+		t.Errorf("Match(assets) = %v", got)
+	}
+	if got := m.Match("class"); got != nil {
+		t.Errorf("Match(class) = %v", got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ｃrypto", "crypto"},
+		{"ⓒⓡⓨⓟⓣⓞ", "crypto"},
+		{"cr\u200bypto", "crypto"},
+		{"𝐜𝐫𝐲𝐩𝐭𝐨", "crypto"},
+		{"сrурtо", "crypto"}, // Cyrillic с, у, о
+		{"crýptô", "crypto"},
+		{"cry\u0301pto\u0302", "crypto"},
+		{"CRYPTO", "CRYPTO"},
+		{"ＣＲＹＰＴＯ", "CRYPTO"},
+		{"ᴄʀʏᴘᴛᴏ", "crypto"},
+		{"नमस्ते", "नमस्ते"},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.in).Text; got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFindNormalizedOffsets(t *testing.T) {
+	m := mustMatcher(t, "Crypto")
+	for _, text := range []string{"buy ｃrypto now", "buy cr\u200bypto now", "buy ⓒⓡⓨⓟⓣⓞ now", "buy crýptô now"} {
+		hits := m.Find(text)
+		if len(hits) != 1 {
+			t.Errorf("Find(%q) = %+v, want one hit", text, hits)
+			continue
+		}
+		want := text[len("buy ") : len(text)-len(" now")]
+		if got := text[hits[0].Start:hits[0].End]; got != want {
+			t.Errorf("Find(%q) spans %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestKeywordCase(t *testing.T) {
+	m := mustMatcher(t, "Free Bitcoin", "ELON")
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"free bitcoin here", []string{"Free Bitcoin"}},
+		{"FREE BITCOIN HERE", []string{"Free Bitcoin"}},
+		{"elon says hi", []string{"ELON"}},
+		{"Еlon says hi", []string{"ELON"}}, // Cyrillic Е
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLeetKeywords(t *testing.T) {
+	m := mustMatcher(t, "free gift | leet", "scam | word, leet", "free money | leet", "gift")
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"fr33 g1ft for you", []string{"free gift"}},
+		{"this is a s.c.a.m", []string{"scam"}},
+		{"this is a scam!", []string{"scam"}},
+		{"what a sc4m!", []string{"scam"}},
+		{"freeeee moneyyy!!!", []string{"free money"}},
+		{"FreeEEe MONEYyy", []string{"free money"}},
+		{"F-R-E-E G.I.F.T", []string{"free gift"}},
+		{"scamp", nil},
+		{"g1ft", nil}, // "gift" is not a leet keyword
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+
+	// Collapsing runs makes short keywords shorter still ("free" → "fre"),
+	// which whole-word matching keeps from hitting innocent words
+	short := mustMatcher(t, "free | leet")
+	for text, want := range map[string][]string{
+		"FREEEE!":                {"free"},
+		"fr33 stuff":             {"free"},
+		"such a fresh take":      nil,
+		"the French revolution":  nil,
+		"Very frequent uploads!": nil,
+	} {
+		if got := short.Match(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("Match(%q) = %v, want %v", text, got, want)
+		}
+	}
+
+	text := "get your fr33 g1ft"
+	hits := m.Find(text)
+	if len(hits) != 1 || text[hits[0].Start:hits[0].End] != "fr33 g1ft" {
+		t.Errorf("Find(%q) = %+v", text, hits)
+	}
+}
+
+func TestLoadKeywordsCache(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "banned_words.txt")
+	cache := list + ".cache"
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(text string, want []string) {
+		t.Helper()
+		m, err := LoadKeywords(list)
+		if err != nil {
+			t.Fatalf("LoadKeywords: %v", err)
+		}
+		if got := m.Match(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("Match(%q) = %v, want %v", text, got, want)
+		}
+	}
+
+	write(list, "crypto\nfree gift | leet\n")
+	load("fr33 g1ft crypto", []string{"free gift", "crypto"})
+	first, err := os.ReadFile(cache)
+	if err != nil {
+		t.Fatalf("cache not written: %v", err)
+	}
+
+	// Unchanged list: the cache is used as is
+	load("fr33 g1ft crypto", []string{"free gift", "crypto"})
+	if again, _ := os.ReadFile(cache); string(again) != string(first) {
+		t.Errorf("cache rewritten although the list did not change")
+	}
+
+	// Changed list: the cache is rebuilt
+	write(list, "crypto\nscam\n")
+	load("fr33 g1ft crypto scam", []string{"crypto", "scam"})
+	if again, _ := os.ReadFile(cache); string(again) == string(first) {
+		t.Errorf("cache not rebuilt after the list changed")
+	}
+
+	// Damaged cache: ignored and replaced
+	write(cache, "garbage")
+	load("crypto scam", []string{"crypto", "scam"})
+	if again, _ := os.ReadFile(cache); string(again) == "garbage" {
+		t.Errorf("damaged cache not replaced")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	yamlRules := `rules:
+  - name: crypto-scam
+    category: scam
+    severity: high
+    action: reject
+    patterns:
+      - crypto giveaway
+      - free gift | leet
+  - name: profanity
+    category: profanity
+    severity: low
+    action: heldForReview
+    patterns:
+      - damn | word
+  - name: slurs
+    category: hate
+    severity: critical
+    action: ban
+    patterns:
+      - slur | word
+`
+	jsonRules := `{"rules": [
+  {"name": "crypto-scam", "category": "scam", "severity": "high", "action": "reject",
+   "patterns": ["crypto giveaway", "free gift | leet"]},
+  {"name": "profanity", "category": "profanity", "severity": "low", "action": "heldForReview",
+   "patterns": ["damn | word"]},
+  {"name": "slurs", "category": "hate", "severity": "critical", "action": "ban",
+   "patterns": ["slur | word"]}
+]}`
+
+	for name, content := range map[string]string{"rules.yaml": yamlRules, "rules.json": jsonRules} {
+		rules, err := LoadRules(testConfig(t, config.Config{}, map[string]string{name: content}).RulesFile)
+		if err != nil {
+			t.Fatalf("LoadRules(%s): %v", name, err)
+		}
+		want := []Rule{
+			{Name: "crypto-scam", Category: "scam", Severity: SeverityHigh, Action: ActionReject,
+				Patterns: []string{"crypto giveaway", "free gift | leet"}},
+			{Name: "profanity", Category: "profanity", Severity: SeverityLow, Action: ActionHold,
+				Patterns: []string{"damn | word"}},
+			{Name: "slurs", Category: "hate", Severity: SeverityCritical, Action: ActionBan,
+				Patterns: []string{"slur | word"}},
+		}
+		if !reflect.DeepEqual(rules, want) {
+			t.Errorf("LoadRules(%s) = %+v, want %+v", name, rules, want)
+		}
+	}
+
+	bad := []string{
+		"rules:\n  - name: x\n    action: delete\n    patterns: [a]\n",
+		"rules:\n  - name: x\n    severity: extreme\n    patterns: [a]\n",
+		"rules:\n  - name: x\n",
+		"rules:\n  - name: x\n    patterns: [\"a | bogus\"]\n",
+		"rules:\n  - name: x\n    pattern: [a]\n",
+		"rules:\n  - name: x\n    signals: [sarcasm]\n",
+		"rules:\n  - name: x\n    signals: [caps]\n",
+		"heuristics:\n  caps: 0.8\nrules:\n  - name: x\n    signals: [caps]\n",
+		"rules:\n  - name: x\n    patterns: [a]\n    languages: [klingon]\n",
+	}
+	for _, content := range bad {
+		if _, err := Load(testConfig(t, config.Config{}, map[string]string{"rules.yaml": content})); err == nil {
+			t.Errorf("Load with rules %q: expected error", content)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m, cfg := mustLoad(t, config.Config{ModeRation: "heldForReview"}, map[string]string{
+		"banned_words.txt": "spam\ncrypto\n",
+		"rules.yaml": `rules:
+  - name: crypto-scam
+    category: scam
+    severity: high
+    action: reject
+    patterns: [crypto giveaway, crypto]
+  - name: mild
+    severity: low
+    action: log
+    patterns: [darn]
+  - name: links
+    action: ban
+    patterns: [bit.ly]
+`,
+	})
+
+	tests := []struct {
+		text   string
+		rule   string
+		action Action
+	}{
+		{"hello there", "", ""},
+		{"darn it", "mild", ActionLog},
+		{"buy spam", "banned_words", ActionHold},
+		{"darn spam", "banned_words", ActionHold},
+		{"crypto giveaway now", "crypto-scam", ActionReject},
+		{"spam bit.ly", "links", ActionBan}, // same severity, harsher action
+		{"crypto at bit.ly", "crypto-scam", ActionReject},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		var rule string
+		if v.Rule != nil {
+			rule = v.Rule.Name
+		}
+		if rule != tt.rule || v.Action != tt.action {
+			t.Errorf("Check(%q) = %s/%s, want %s/%s", tt.text, rule, v.Action, tt.rule, tt.action)
+		}
+	}
+
+	// A phrase shared by two rules is reported for both
+	v := m.Check("crypto")
+	if len(v.Hits) != 2 {
+		t.Errorf("Check(crypto) hits = %+v, want one per rule", v.Hits)
+	}
+
+	// Without a rules file the plain list is required
+	if _, err := Load(testConfig(t, config.Config{}, nil)); err == nil {
+		t.Errorf("Load without any list: expected error")
+	}
+	cfg.ModeRation = "published"
+	if _, err := Load(cfg); err == nil {
+		t.Errorf("Load with an unknown MODE_RATION: expected error")
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	m, cfg := mustLoad(t, config.Config{}, map[string]string{
+		"banned_words.txt": "scam\nfree gift | leet\ncrypto\n",
+		"allowlist.txt":    "scam awareness\nFreeGift Inc | word\nfree gift inc\n",
+	})
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Scam awareness week", nil},
+		{"scam awareness, but this one is a scam", []string{"scam"}},
+		{"Thanks to Free Gift Inc for sponsoring", nil},
+		{"fr33 g1ft here", []string{"free gift"}},
+		{"crypto scam awareness", []string{"crypto"}},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+
+	if v := m.Check("scam awareness"); v.Rule != nil || len(v.Hits) != 0 {
+		t.Errorf("Check(scam awareness) = %+v, want no verdict", v)
+	}
+
+	cfg.AllowlistFile += ".missing"
+	if _, err := Load(cfg); err == nil {
+		t.Errorf("Load with a missing allowlist: expected error")
+	}
+}
+
+func TestRequiredLiterals(t *testing.T) {
+	tests := []struct {
+		re   string
+		want []string
+	}{
+		{`wa\.me/\d+`, []string{"wa.me/"}},
+		{`t\.me/\w+bot`, []string{"t.me/"}},
+		{`(?i)telegram|whatsapp`, []string{"telegram", "whatsapp"}},
+		{`(free|cheap) (robux|vbucks)`, []string{"robux", "vbucks"}},
+		{`(bit\.ly)+/\w+`, []string{"bit.ly"}},
+		{`\+?\d{3}[-. ]?\d{3}[-. ]?\d{4}`, nil},
+		{`(https?://)?x`, []string{"x"}},
+		{`a*b?`, nil},
+		{`(foo|\d+)bar`, []string{"bar"}},
+	}
+	for _, tt := range tests {
+		if got := requiredLiterals(tt.re); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("requiredLiterals(%q) = %q, want %q", tt.re, got, tt.want)
+		}
+	}
+}
+
+func TestRegexRules(t *testing.T) {
+	m, _ := mustLoad(t, config.Config{}, map[string]string{"rules.yaml": `rules:
+  - name: contact-scam
+    category: scam
+    severity: high
+    action: reject
+    regexes:
+      - 'wa\.me/\d+'
+      - '(?i)t\.me/\w+bot\b'
+  - name: phone
+    action: hold
+    regexes:
+      - '\+?\d{3}[-. ]\d{3}[-. ]\d{4}'
+`})
+	tests := []struct {
+		text  string
+		match string
+		rule  string
+	}{
+		{"message me wa.me/15551234567 now", "wa.me/15551234567", "contact-scam"},
+		{"join T.ME/FreeCoinsBot", "T.ME/FreeCoinsBot", "contact-scam"},
+		{"join ｔ.ｍｅ/coinbot", "ｔ.ｍｅ/coinbot", "contact-scam"},
+		{"call 555-123-4567", "555-123-4567", "phone"},
+		{"wa.me without a number", "", ""},
+		{"the t.me/channel link", "", ""},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		var match, rule string
+		if len(v.Hits) > 0 {
+			match = tt.text[v.Hits[0].Start:v.Hits[0].End]
+		}
+		if v.Rule != nil {
+			rule = v.Rule.Name
+		}
+		if match != tt.match || rule != tt.rule {
+			t.Errorf("Check(%q) = %q by %q, want %q by %q", tt.text, match, rule, tt.match, tt.rule)
+		}
+	}
+
+	bad := map[string]string{"rules.yaml": "rules:\n  - name: bad\n    regexes: ['(unclosed']\n"}
+	if _, err := Load(testConfig(t, config.Config{}, bad)); err == nil {
+		t.Errorf("Load with an invalid regex: expected error")
+	}
+}
+
+// regexBenchSet returns a set of n regexes, each with its own literal
+func regexBenchSet(n int, prefilter bool) *regexSet {
+	var patterns []regexPattern
+	for i := 0; i < n; i++ {
+		src := fmt.Sprintf(`promo%dcode\d+`, i)
+		patterns = append(patterns, regexPattern{source: src, re: regexp.MustCompile(src), rule: defaultRule})
+	}
+	s := newRegexSet(patterns)
+	if !prefilter {
+		s.ac, s.owners, s.always = nil, nil, nil
+		for i := range patterns {
+			s.always = append(s.always, i)
+		}
+	}
+	return s
+}
+
+var regexBenchText = Normalize(strings.Repeat("Great video, I learned a lot about regular expressions today! ", 16))
+
+func BenchmarkRegexRules(b *testing.B) {
+	s := regexBenchSet(300, true)
+	b.SetBytes(int64(len(regexBenchText.Text)))
+	for i := 0; i < b.N; i++ {
+		s.find(regexBenchText)
+	}
+}
+
+func BenchmarkRegexRulesUnfiltered(b *testing.B) {
+	s := regexBenchSet(300, false)
+	b.SetBytes(int64(len(regexBenchText.Text)))
+	for i := 0; i < b.N; i++ {
+		s.find(regexBenchText)
+	}
+}
+
+func TestDamerauLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"crypto", "crypto", 0},
+		{"crypto", "crytpo", 1},
+		{"giveaway", "giveawey", 1},
+		{"crypto", "cripto", 1},
+		{"crypto", "crypt", 1},
+		{"crypto", "ccrypto", 1},
+		{"ca", "abc", 2}, // 3 for the restricted variant
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+	}
+	for _, tt := range tests {
+		if got := damerauLevenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("damerauLevenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := damerauLevenshtein([]rune(tt.b), []rune(tt.a)); got != tt.want {
+			t.Errorf("damerauLevenshtein(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyKeywords(t *testing.T) {
+	m := mustMatcher(t, "crypto | fuzzy", "giveaway | fuzzy", "free gift | fuzzy=2", "scam")
+	tests := []struct {
+		text     string
+		want     []string
+		distance []int
+	}{
+		{"crytpo here", []string{"crypto"}, []int{1}},
+		{"CRYPTO here", []string{"crypto"}, []int{0}},
+		{"big giveawey today", []string{"giveaway"}, []int{1}},
+		{"fre gfit for you", []string{"free gift"}, []int{2}},
+		{"cryptocurrency", nil, nil}, // whole words only
+		{"cryp to", nil, nil},        // too far
+		{"crytpo scam", []string{"crypto", "scam"}, []int{1, 0}},
+	}
+	for _, tt := range tests {
+		hits := m.Find(tt.text)
+		var distance []int
+		for _, h := range hits {
+			distance = append(distance, h.Distance)
+		}
+		if got := Words(hits); !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(distance, tt.distance) {
+			t.Errorf("Find(%q) = %v at %v, want %v at %v", tt.text, got, distance, tt.want, tt.distance)
+		}
+	}
+
+	if got := Describe(m.Find("crytpo crypto scam")); !reflect.DeepEqual(got, []string{"crypto~1", "crypto", "scam"}) {
+		t.Errorf("Describe = %v", got)
+	}
+
+	text := "Join the Crytpo givaway!"
+	hits := m.Find(text)
+	if len(hits) != 2 || text[hits[0].Start:hits[0].End] != "Crytpo" || text[hits[1].Start:hits[1].End] != "givaway" {
+		t.Errorf("Find(%q) = %+v", text, hits)
+	}
+
+	m = mustMatcher(t, "free gift | fuzzy, leet")
+	if got := m.Match("fr33 g1fft"); !reflect.DeepEqual(got, []string{"free gift"}) {
+		t.Errorf("Match(fr33 g1fft) = %v", got)
+	}
+}
+
+func TestBKTreeMatchesBruteForce(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	word := func() []rune {
+		w := make([]rune, 1+r.Intn(7))
+		for i := range w {
+			w[i] = rune('a' + r.Intn(4))
+		}
+		return w
+	}
+
+	var tree bkTree
+	var terms [][]rune
+	for i := 0; i < 300; i++ {
+		w := word()
+		terms = append(terms, w)
+		tree.add(w, i, 2)
+	}
+	for q := 0; q < 200; q++ {
+		w := word()
+		got := make(map[int]int)
+		tree.search(w, func(owners []int, d int) {
+			for _, k := range owners {
+				got[k] = d
+			}
+		})
+		want := make(map[int]int)
+		for k, term := range terms {
+			if d := damerauLevenshtein(w, term); d <= 2 {
+				want[k] = d
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("search(%q) = %v, want %v", string(w), got, want)
+		}
+	}
+}
+
+func TestScoring(t *testing.T) {
+	list := "crypto\nbitcoin | weight=0.5\nwallet\ngiveaway | fuzzy, weight=2\n"
+	m, _ := mustLoad(t, config.Config{ModeRation: "heldForReview", HoldScore: 2, RejectScore: 4}, map[string]string{
+		"banned_words.txt": list,
+		"rules.yaml": `rules:
+  - name: scam
+    weight: 1.5
+    patterns: [double your money, telegram | weight=3]
+  - name: slurs
+    severity: critical
+    action: ban
+    weight: 0.1
+    patterns: [someslur]
+`,
+	})
+
+	tests := []struct {
+		text   string
+		score  float64
+		action Action
+		rule   string
+	}{
+		{"crypto", 1, "", ""},
+		{"crypto crypto crypto", 1, "", ""}, // repeats count once
+		{"crypto wallet", 2, ActionHold, ""},
+		{"bitcoin crypto", 1.5, "", ""},
+		{"double your money", 1.5, "", ""},
+		{"crypto double your money on telegram", 5.5, ActionReject, ""},
+		{"giveawey", 1, "", ""}, // fuzzy hit at half weight
+		{"giveaway", 2, ActionHold, ""},
+		{"someslur", 0.1, ActionBan, "slurs"}, // explicit action still applies
+		{"someslur crypto wallet telegram", 5.1, ActionBan, "slurs"},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		var rule string
+		if v.Rule != nil {
+			rule = v.Rule.Name
+		}
+		if v.Score == nil || math.Abs(v.Score.Total-tt.score) > 1e-9 || v.Action != tt.action || rule != tt.rule {
+			t.Errorf("Check(%q) = score %v, %q by %q; want %g, %q by %q", tt.text, v.Score, v.Action, rule, tt.score, tt.action, tt.rule)
+		}
+	}
+
+	if got := m.Check("crypto crypto wallet").Score.String(); got != "2 = crypto 1 (×2) + wallet 1" {
+		t.Errorf("Score.String() = %q", got)
+	}
+	if v := m.Check("hello"); v.Score != nil || v.Action != "" {
+		t.Errorf("Check(hello) = %+v", v)
+	}
+
+	// Without thresholds, any hit decides as before
+	m, _ = mustLoad(t, config.Config{ModeRation: "heldForReview"}, map[string]string{"banned_words.txt": list})
+	if v := m.Check("crypto"); v.Score != nil || v.Action != ActionHold {
+		t.Errorf("Check(crypto) without scoring = %+v", v)
+	}
+
+	if _, err := ParseKeyword("crypto | weight=-1"); err == nil {
+		t.Errorf("ParseKeyword with a negative weight: expected error")
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		text       string
+		host       string
+		raw        string
+		obfuscated bool
+		kind       LinkKind
+	}{
+		{"visit https://Example.com/path?x=1 now", "example.com", "https://Example.com/path?x=1", false, ""},
+		{"go to www.example.org", "example.org", "www.example.org", false, ""},
+		{"join t.me/freecoins", "t.me", "t.me/freecoins", false, LinkInvite},
+		{"bit.ly/abc", "bit.ly", "bit.ly/abc", false, LinkShortener},
+		{"example dot com", "example.com", "example dot com", true, ""},
+		{"example[.]com", "example.com", "example[.]com", true, ""},
+		{"example (dot) xyz", "example.xyz", "example (dot) xyz", true, ""},
+		{"www dot scamsite dot net", "scamsite.net", "www dot scamsite dot net", true, ""},
+		{"hxxps://evil.example.net/x", "evil.example.net", "hxxps://evil.example.net/x", false, ""},
+		{"ｅｘａｍｐｌｅ．ｃｏｍ", "example.com", "ｅｘａｍｐｌｅ．ｃｏｍ", false, ""},
+		{"chat.whatsapp.com/AbC", "chat.whatsapp.com", "chat.whatsapp.com/AbC", false, LinkInvite},
+		{"discord.com/invite/xyz", "discord.com", "discord.com/invite/xyz", false, LinkInvite},
+	}
+	for _, tt := range tests {
+		links := ExtractLinks(tt.text)
+		if len(links) != 1 {
+			t.Errorf("ExtractLinks(%q) = %+v, want one link", tt.text, links)
+			continue
+		}
+		l := links[0]
+		if l.Host != tt.host || tt.text[l.Start:l.End] != tt.raw || l.URL != tt.raw || l.Obfuscated != tt.obfuscated || l.Kind != tt.kind || l.Lookalike != "" {
+			t.Errorf("ExtractLinks(%q) = %+v", tt.text, l)
+		}
+	}
+
+	// Hosts written with look-alike letters keep them, and tell what
+	// they imitate
+	for text, want := range map[string]Link{
+		"log in at https://раураl.com/login": {Host: "раураl.com", Lookalike: "paypal.com"},
+		"visit pàypal.com":                   {Host: "pàypal.com", Lookalike: "paypal.com"},
+		"join t.mе/freecoins":                {Host: "t.mе", Lookalike: "t.me"},
+	} {
+		links := ExtractLinks(text)
+		if len(links) != 1 || links[0].Host != want.Host || links[0].Lookalike != want.Lookalike || !links[0].Obfuscated || links[0].Kind != "" {
+			t.Errorf("ExtractLinks(%q) = %+v, want host %q imitating %q", text, links, want.Host, want.Lookalike)
+		}
+	}
+
+	for _, text := range []string{
+		"the end.of the sentence",
+		"mail me at someone@example.com",
+		"version 1.2.3",
+		"discord.com/channels/1",
+		"the dot com bubble burst",
+		"he said hi dot com was bad",
+		"the whole dot com era",
+	} {
+		links := ExtractLinks(text)
+		if text == "discord.com/channels/1" {
+			if len(links) != 1 || links[0].Kind != "" {
+				t.Errorf("ExtractLinks(%q) = %+v, want a plain link", text, links)
+			}
+		} else if len(links) != 0 {
+			t.Errorf("ExtractLinks(%q) = %+v, want none", text, links)
+		}
+	}
+
+	// TextDisplay markup: external links come wrapped in YouTube
+	// redirects, and tags are not scanned as text
+	html := `Check <a href="https://www.youtube.com/redirect?event=comments&amp;q=https%3A%2F%2Fbit.ly%2Fxyz">bit.ly/xyz</a><br>` +
+		`at <a href="https://www.youtube.com/watch?v=abc&amp;t=60">1:00</a>`
+	links := ExtractLinks(html)
+	var hosts []string
+	for _, l := range links {
+		hosts = append(hosts, l.Host)
+	}
+	if !reflect.DeepEqual(hosts, []string{"bit.ly", "youtube.com", "bit.ly"}) {
+		t.Errorf("ExtractLinks(html) hosts = %v", hosts)
+	} else if links[0].URL != "https://bit.ly/xyz" || links[0].Kind != LinkShortener {
+		t.Errorf("ExtractLinks(html) = %+v", links[0])
+	}
+}
+
+func TestLinkPolicy(t *testing.T) {
+	files := map[string]string{"banned_words.txt": "crypto\n"}
+	m, cfg := mustLoad(t, config.Config{
+		ModeRation:              "heldForReview",
+		AllowedDomains:          []string{"mychannel.com", "discord.gg/myserver"},
+		DeniedDomains:           []string{"evil.com"},
+		DeniedDomainAction:      "reject",
+		NonSubscriberLinkAction: "hold",
+	}, files)
+
+	tests := []struct {
+		text       string
+		action     Action
+		links      int
+		linkAction Action
+	}{
+		{"no links here", "", 0, ""},
+		{"see https://youtu.be/abc", "", 0, ""},
+		{"merch at shop.mychannel.com", "", 0, ""},
+		{"join discord.gg/myserver", "", 0, ""},
+		{"join discord.gg/other", "", 1, ActionHold},
+		{"my blog example.com", "", 1, ActionHold},
+		{"go to evil dot com", ActionReject, 1, ActionHold},
+		{"cdn.evil.com/x", ActionReject, 1, ActionHold},
+		{"bit.ly/abc", "", 1, ActionHold},
+		{"join t.me/freecoins", "", 1, ActionHold},
+		{"merch at https://mусhаnnеl.com", ActionReject, 1, ActionHold}, // Cyrillic у, с, а, е
+		{"merch at ｍｙｃｈａｎｎｅｌ．ｃｏｍ", "", 0, ""},
+		{"watch yоutube.com/live", ActionReject, 1, ActionHold},
+		{"cdn.еvil.com/x", ActionReject, 1, ActionHold},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		if v.Action != tt.action || len(v.Links) != tt.links || v.LinkAction != tt.linkAction {
+			t.Errorf("Check(%q) = action %q, %d links, link action %q; want %q, %d, %q",
+				tt.text, v.Action, len(v.Links), v.LinkAction, tt.action, tt.links, tt.linkAction)
+		}
+	}
+
+	// Shorteners and invites are only denied when asked for, and can
+	// still be allowed one by one
+	m, _ = mustLoad(t, config.Config{
+		AllowedDomains:           []string{"discord.gg/myserver"},
+		DenyShortenersAndInvites: true,
+		DeniedDomainAction:       "reject",
+	}, files)
+	for text, want := range map[string]Action{
+		"bit.ly/abc":               ActionReject,
+		"join t.me/freecoins":      ActionReject,
+		"join discord.gg/myserver": "",
+		"join discord.gg/other":    ActionReject,
+		"my blog example.com":      "",
+	} {
+		if v := m.Check(text); v.Action != want {
+			t.Errorf("Check(%q) with shorteners denied = action %q, want %q", text, v.Action, want)
+		}
+	}
+
+	cfg.NonSubscriberLinkAction = "explode"
+	if _, err := Load(cfg); err == nil {
+		t.Errorf("Load with an unknown link action: expected error")
+	}
+}
+
+func TestCheckComment(t *testing.T) {
+	m, _ := mustLoad(t, config.Config{
+		DeniedDomains:           []string{"evil.com"},
+		DeniedDomainAction:      "reject",
+		NonSubscriberLinkAction: "hold",
+	}, map[string]string{"banned_words.txt": "crypto\n"})
+
+	html := `see <a href="https://evil.com/x">here</a> and evil.com/x`
+	if v := m.Check("see here"); v.Action != "" || len(v.Links) != 0 {
+		t.Errorf("Check(plain text) = %+v, want nothing", v)
+	}
+	v := m.CheckComment("see here and evil.com/x", html)
+	if v.Action != ActionReject || len(v.Links) != 1 || v.LinkAction != ActionHold {
+		t.Errorf("CheckComment = action %q, links %+v, link action %q", v.Action, v.Links, v.LinkAction)
+	}
+	v = m.CheckComment("see here", `see <a href="https://evil.com/x">here</a>`)
+	if v.Action != ActionReject || len(v.Links) != 1 {
+		t.Errorf("CheckComment with the link only in the href = action %q, links %+v", v.Action, v.Links)
+	}
+
+	// An allowlisted anchor text does not cancel its href, which is not
+	// highlighted in the text
+	m, _ = mustLoad(t, config.Config{DeniedDomains: []string{"evil.com"}, DeniedDomainAction: "reject"}, map[string]string{
+		"banned_words.txt": "crypto\n",
+		"allowlist.txt":    "scam awareness\n",
+	})
+	text := "Read this scam awareness"
+	v = m.CheckComment(text, `Read this <a href="https://evil.com/x">scam awareness</a>`)
+	if v.Action != ActionReject || len(v.Hits) != 1 || v.Hits[0].Start != v.Hits[0].End {
+		t.Errorf("CheckComment with an allowlisted anchor text = action %q, hits %+v", v.Action, v.Hits)
+	}
+	if got := Highlight(text, v.Hits); got != text {
+		t.Errorf("Highlight = %q, want nothing marked", got)
+	}
+}
+
+func TestHeuristics(t *testing.T) {
+	h := &Heuristics{EmojiRatio: 0.5, CapsRatio: 0.8, MaxRun: 5, MinEntropy: 1.5, MaxLength: 60, MinLength: 3, MixedScript: true}
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Thanks for the video, really helpful!", nil},
+		{"🔥🔥🔥😂😂😂👍👍👍🙏🙏 great", []string{SignalEmoji}},
+		{"🔥", []string{SignalShort}},
+		{"THIS IS THE BEST VIDEO EVER MADE", []string{SignalCaps}},
+		{"OK", []string{SignalShort}},
+		{"NASA and the ESA launched it", nil},
+		{"spam spam spam Spam SPAM spam", []string{SignalRepetition}},
+		{"nooooooo way", []string{SignalRepetition}},
+		{"aaaa aaaa aaaa", []string{SignalLowEntropy}},
+		{strings.Repeat("a long comment ", 5), []string{SignalLong}},
+		{"Free P\u0430yPal money", []string{SignalMixedScript}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, s := range h.Detect(Normalize(tt.text)) {
+			got = append(got, s.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Detect(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+
+	// Disabled heuristics raise nothing
+	if got := (&Heuristics{}).Detect(Normalize("AAAAAAAAAAAAAAAA 🔥🔥🔥🔥🔥🔥🔥🔥🔥🔥")); got != nil {
+		t.Errorf("Detect with no thresholds = %v, want none", got)
+	}
+}
+
+func TestSignalRules(t *testing.T) {
+	m, _ := mustLoad(t, config.Config{}, map[string]string{"rules.yaml": `heuristics:
+  caps_ratio: 0.8
+  max_run: 5
+rules:
+  - name: shouting
+    severity: low
+    action: hold
+    signals: [caps]
+  - name: shouted-scam
+    severity: high
+    action: reject
+    signals: [caps]
+    patterns:
+      - free | word
+  - name: flood
+    severity: medium
+    action: reject
+    signals: [caps, repetition]
+`})
+
+	tests := []struct {
+		text   string
+		rule   string
+		action Action
+		words  []string
+	}{
+		{"a free gift for everyone who watches", "", "", nil},
+		{"WHAT A GREAT VIDEO, THANK YOU", "shouting", ActionHold, []string{"[caps]"}},
+		{"GET YOUR FREE GIFT NOW, LINK IN BIO", "shouted-scam", ActionReject, []string{"[caps]", "free"}},
+		{"LOL LOL LOL LOL LOL LOL LOL", "flood", ActionReject, []string{"[caps]", "[caps+repetition]"}},
+		{"lol lol lol lol lol lol lol", "", "", nil},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		var rule string
+		if v.Rule != nil {
+			rule = v.Rule.Name
+		}
+		if rule != tt.rule || v.Action != tt.action || !reflect.DeepEqual(Words(v.Hits), tt.words) {
+			t.Errorf("Check(%q) = rule %q, action %q, words %v; want %q, %q, %v",
+				tt.text, rule, v.Action, Words(v.Hits), tt.rule, tt.action, tt.words)
+		}
+	}
+
+	v := m.Check("lol lol lol lol lol lol lol")
+	if want := []Signal{{Name: SignalRepetition, Value: 7}}; !reflect.DeepEqual(v.Signals, want) {
+		t.Errorf("Signals = %v, want %v", v.Signals, want)
+	}
+	if got := Highlight("WHAT A GREAT VIDEO, THANK YOU", m.Find("WHAT A GREAT VIDEO, THANK YOU")); got != "WHAT A GREAT VIDEO, THANK YOU" {
+		t.Errorf("Highlight marked signal hits: %q", got)
+	}
+}
+
+func TestMixedScriptWords(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"PayPal support", nil},
+		{"PаyPal support", []string{"PаyPal"}},     // Cyrillic а
+		{"ΝETFLIX and chill", []string{"ΝETFLIX"}}, // Greek Ν
+		{"привет world", nil},                      // separate words
+		{"YouTubeで見た", nil},                        // Latin and Japanese
+		{"crýptô", nil},
+	}
+	for _, tt := range tests {
+		if got := mixedScriptWords(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mixedScriptWords(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSkeleton(t *testing.T) {
+	same := []string{"PayPal", "PayPaI", "paypa1", "Pay Pal", "PаyPаl", "ＰａｙＰａｌ", "PayPa|"}
+	for _, s := range same {
+		if got, want := skeleton(s), skeleton("PayPal"); got != want {
+			t.Errorf("skeleton(%q) = %q, want %q", s, got, want)
+		}
+	}
+	if got, want := skeleton("Mr Beast"), skeleton("Mr Bearst"); got == want {
+		t.Errorf("skeleton(%q) = skeleton(%q) = %q", "Mr Beast", "Mr Bearst", got)
+	}
+	if got, want := skeleton("modern"), skeleton("modem"); got != want {
+		t.Errorf("skeleton(modern) = %q, want %q", got, want)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	m, cfg := mustLoad(t, config.Config{
+		ProtectedTerms:      []string{"PayPal", "Linus Tech Tips", "YouTube"},
+		ImpersonationAction: "reject",
+	}, map[string]string{"banned_words.txt": "crypto\n"})
+
+	tests := []struct {
+		text   string
+		action Action
+		words  []string
+	}{
+		{"I paid with PayPal, thanks!", "", nil},
+		{"Linus Tech Tips did a video on this", "", nil},
+		{"watch youtube premium", "", nil},
+		{"Contact PayPaI support now", ActionReject, []string{"PayPal"}},
+		{"PаyPal giveaway", ActionReject, []string{"PayPal"}},
+		{"Official LinusTechTlps giveaway", ActionReject, []string{"Linus Tech Tips"}},
+		{"message Y0uTube team", ActionReject, []string{"YouTube"}},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		if v.Action != tt.action || !reflect.DeepEqual(Words(v.Hits), tt.words) {
+			t.Errorf("Check(%q) = action %q, words %v; want %q, %v", tt.text, v.Action, Words(v.Hits), tt.action, tt.words)
+		}
+	}
+
+	hits := m.Find("Contact PayPaI support")
+	if len(hits) != 1 || Highlight("Contact PayPaI support", hits) != "Contact «PayPaI» support" {
+		t.Errorf("Find = %+v", hits)
+	}
+
+	// Only the listed terms are protected
+	m, _ = mustLoad(t, config.Config{ProtectedTerms: []string{"PayPal"}}, map[string]string{"banned_words.txt": "crypto\n"})
+	if v := m.Check("message Y0uTube team"); v.Action != "" || len(v.Hits) != 0 {
+		t.Errorf("Check(Y0uTube) without YouTube protected = %+v, want nothing", v)
+	}
+	m, _ = mustLoad(t, config.Config{}, map[string]string{"banned_words.txt": "crypto\n"})
+	if v := m.Check("Contact PayPaI support"); v.Action != "" || len(v.Hits) != 0 {
+		t.Errorf("Check(PayPaI) without protected terms = %+v, want nothing", v)
+	}
+
+	cfg.ImpersonationAction = "explode"
+	if _, err := Load(cfg); err == nil {
+		t.Errorf("Load with an unknown impersonation action: expected error")
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"This is a great video, thanks for sharing", "en"},
+		{"I didn't understand anything", "en"},
+		{"Me encanta este canal, saludos", "es"},
+		{"Hola, como estas? Muy bien el video", "es"},
+		{"Adorei o vídeo, muito bom mesmo", "pt"},
+		{"Olá, tudo bem? Muito bom o vídeo", "pt"},
+		{"बहुत अच्छा वीडियो है भाई", "hi"},
+		{"bhai kya video banaya hai, maza aa gaya", "hi"},
+		{"lol", ""},
+		{"🔥🔥🔥", ""},
+	}
+	for _, tt := range tests {
+		if got := DetectLanguage(tt.text); got != tt.want {
+			t.Errorf("DetectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if got, want := Languages(), []string{"en", "es", "hi", "pt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Languages() = %v, want %v", got, want)
+	}
+}
+
+func TestLanguageKeywords(t *testing.T) {
+	m, cfg := mustLoad(t, config.Config{}, map[string]string{
+		"banned_words.txt":    "scam\n",
+		"banned_words.es.txt": "tonto | word\n",
+		"banned_words.pt.txt": "burro | word\n",
+	})
+
+	tests := []struct {
+		text  string
+		words []string
+		lang  string
+	}{
+		{"eres un tonto, no sabes lo que dices", []string{"tonto"}, "es"},
+		{"el burro de mi abuelo come mucho pasto", nil, "es"},
+		{"você é muito burro cara, não sabe nada", []string{"burro"}, "pt"},
+		{"burro", nil, ""},
+		{"this is a scam, do not trust him", []string{"scam"}, ""},
+		{"esto es un scam, no confíes en él", []string{"scam"}, ""},
+	}
+	for _, tt := range tests {
+		v := m.Check(tt.text)
+		if !reflect.DeepEqual(Words(v.Hits), tt.words) || v.Language != tt.lang {
+			t.Errorf("Check(%q) = words %v, language %q; want %v, %q", tt.text, Words(v.Hits), v.Language, tt.words, tt.lang)
+		}
+	}
+
+	cfg.LanguageKeywordFiles["xx"] = cfg.LanguageKeywordFiles["es"]
+	if _, err := Load(cfg); err == nil {
+		t.Errorf("Load with a list for an unknown language: expected error")
+	}
+}
+
+func BenchmarkDetectLanguage(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		DetectLanguage("Olá, tudo bem? Muito bom o vídeo, aprendi muito com você")
+	}
+}
+
+// fakeClassify is the verdict of the fake external classifiers below
+func fakeClassify(text string) ExternalResult {
+	var res ExternalResult
+	if strings.Contains(text, "spam") {
+		res.Score = 0.99
+	} else if strings.Contains(text, "meh") {
+		res.Score = 0.8
+	}
+	if strings.Contains(text, "idiot") {
+		res.Labels = append(res.Labels, "insult")
+	}
+	return res
+}
+
+func TestExternalHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var c ExternalComment
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case strings.Contains(c.Text, "hang"):
+			<-r.Context().Done()
+			return
+		case strings.Contains(c.Text, "crash"):
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(fakeClassify(c.Text))
+	}))
+	defer srv.Close()
+
+	cfg := &config.ExternalClassifier{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Timeout: 100 * time.Millisecond,
+		Hold:    0.7,
+		Reject:  0.95,
+		Labels:  map[string]string{"insult": "hold"},
+	}
+	testExternal(t, cfg)
+
+	cfg.Headers = nil
+	e, err := NewExternal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.Check(context.Background(), ExternalComment{Text: "hello"}); err == nil {
+		t.Errorf("Check without the Authorization header: expected error")
+	}
+}
+
+func TestExternalCommand(t *testing.T) {
+	cfg := &config.ExternalClassifier{
+		Command: []string{os.Args[0], "-test.run=^TestExternalHelperProcess$"},
+		Timeout: 500 * time.Millisecond,
+		Hold:    0.7,
+		Reject:  0.95,
+		Labels:  map[string]string{"insult": "hold"},
+	}
+	t.Setenv("TUBEGUARDIAN_HELPER_PROCESS", "1")
+	testExternal(t, cfg)
+}
+
+// testExternal checks an external classifier that answers like
+// fakeClassify, hangs on "hang" and fails on "crash"
+func testExternal(t *testing.T, cfg *config.ExternalClassifier) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, fail := range []string{"open", "closed"} {
+		cfg.Fail = fail
+		e, err := NewExternal(cfg)
+		if err != nil {
+			t.Fatalf("NewExternal: %v", err)
+		}
+		defer e.Close()
+
+		tests := []struct {
+			text   string
+			action Action
+			err    bool
+		}{
+			{"great video", "", false},
+			{"meh", ActionHold, false},
+			{"buy my spam", ActionReject, false},
+			{"you idiot", ActionHold, false},
+			{"crash", "", true},
+			{"hang", "", true},
+			{"still works after a failure, spam", ActionReject, false},
+		}
+		for _, tt := range tests {
+			want := tt.action
+			if tt.err && fail == "closed" {
+				want = ActionHold
+			}
+			action, _, err := e.Check(ctx, ExternalComment{ID: "c1", Text: tt.text})
+			if action != want || (err != nil) != tt.err {
+				t.Errorf("fail %s: Check(%q) = %q, %v; want %q, error %v", fail, tt.text, action, err, want, tt.err)
+			}
+		}
+	}
+}
+
+// TestExternalHelperProcess is not a real test: it is the subprocess of
+// TestExternalCommand, answering comments on stdin like fakeClassify
+func TestExternalHelperProcess(t *testing.T) {
+	if os.Getenv("TUBEGUARDIAN_HELPER_PROCESS") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var c ExternalComment
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			os.Exit(2)
+		}
+		switch {
+		case strings.Contains(c.Text, "hang"):
+			time.Sleep(time.Minute)
+		case strings.Contains(c.Text, "crash"):
+			os.Exit(1)
+		}
+		data, _ := json.Marshal(fakeClassify(c.Text))
+		fmt.Printf("%s\n", data)
+	}
+	os.Exit(0)
+}
+
+func TestNewExternalErrors(t *testing.T) {
+	bad := []config.ExternalClassifier{
+		{},
+		{URL: "http://localhost", Command: []string{"cat"}},
+		{URL: "http://localhost", Fail: "sideways"},
+		{URL: "http://localhost", Labels: map[string]string{"toxic": "explode"}},
+	}
+	for _, cfg := range bad {
+		if _, err := NewExternal(&cfg); err == nil {
+			t.Errorf("NewExternal(%+v): expected error", cfg)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package filter
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// fuzzyIndex finds keywords that occur misspelled ("crytpo" for
+// "crypto"). Fuzzy keywords match whole words: a keyword of n words is
+// compared with every run of n consecutive words of the comment, and
+// matches if the Damerau-Levenshtein distance between them is at most
+// the keyword's Fuzzy distance.
+//
+// Keywords are kept in one BK-tree per word count, so that a comparison
+// only visits the keywords that can be close enough.
+type fuzzyIndex struct {
+	trees []*bkTree // trees[n-1] holds the keywords of n words
+}
+
+// newFuzzyIndex builds a fuzzyIndex from the keywords for which include
+// returns true, using form to turn each keyword into its term. It
+// returns nil if no keyword is included.
+func newFuzzyIndex(keywords []Keyword, include func(Keyword) bool, form func(string) string) *fuzzyIndex {
+	idx := new(fuzzyIndex)
+	for i, kw := range keywords {
+		if !include(kw) {
+			continue
+		}
+		words := strings.FieldsFunc(ahocorasick.Fold(form(kw.Text)), func(r rune) bool { return !isWordRune(r) })
+		if len(words) == 0 {
+			continue
+		}
+		for len(idx.trees) < len(words) {
+			idx.trees = append(idx.trees, new(bkTree))
+		}
+		idx.trees[len(words)-1].add([]rune(strings.Join(words, " ")), i, kw.Fuzzy)
+	}
+	if len(idx.trees) == 0 {
+		return nil
+	}
+	return idx
+}
+
+// token is a word of the scanned text
+type token struct {
+	start, end int
+}
+
+// find returns a hit for every run of words in text that is close
+// enough to a keyword
+func (idx *fuzzyIndex) find(text Normalized, keywords []Keyword) []Hit {
+	var tokens []token
+	for i := 0; i < len(text.Text); {
+		r, size := utf8.DecodeRuneInString(text.Text[i:])
+		if !isWordRune(r) {
+			i += size
+			continue
+		}
+		start := i
+		for i < len(text.Text) {
+			r, size = utf8.DecodeRuneInString(text.Text[i:])
+			if !isWordRune(r) {
+				break
+			}
+			i += size
+		}
+		tokens = append(tokens, token{start, i})
+	}
+
+	type match struct{ keyword, distance int }
+	var hits []Hit
+	var term []rune
+	var matches []match
+	for first := range tokens {
+		for n := 1; n <= len(idx.trees) && first+n <= len(tokens); n++ {
+			term = term[:0]
+			for k := first; k < first+n; k++ {
+				if k > first {
+					term = append(term, ' ')
+				}
+				for _, r := range text.Text[tokens[k].start:tokens[k].end] {
+					term = append(term, ahocorasick.FoldRune(r))
+				}
+			}
+
+			matches = matches[:0]
+			idx.trees[n-1].search(term, func(owners []int, d int) {
+				for _, k := range owners {
+					if d <= keywords[k].Fuzzy {
+						matches = append(matches, match{k, d})
+					}
+				}
+			})
+			// The search order depends on map iteration, report in
+			// keyword order
+			sort.Slice(matches, func(i, j int) bool { return matches[i].keyword < matches[j].keyword })
+
+			at := len(hits)
+			for _, mt := range matches {
+				kw := keywords[mt.keyword]
+				if hasRule(hits[at:], kw.Rule) {
+					continue
+				}
+				start, end := text.Span(tokens[first].start, tokens[first+n-1].end)
+				hits = append(hits, Hit{
+					Word:     kw.Text,
+					Start:    start,
+					End:      end,
+					Rule:     kw.Rule,
+					Distance: mt.distance,
+					Weight:   kw.weight(),
+				})
+			}
+		}
+	}
+	return hits
+}
+
+// bkTree is a BK-tree of terms. Each child of a node is keyed by its
+// distance to the node, so the triangle inequality lets a search skip
+// every subtree that cannot hold a term within range.
+type bkTree struct {
+	root   *bkNode
+	radius int // largest distance any term accepts
+}
+
+type bkNode struct {
+	term     []rune
+	owners   []int // keyword indexes with this term
+	children map[int]*bkNode
+}
+
+// add inserts term for keyword k, which accepts terms within distance
+func (t *bkTree) add(term []rune, k, distance int) {
+	t.radius = max(t.radius, distance)
+	if t.root == nil {
+		t.root = &bkNode{term: term, owners: []int{k}}
+		return
+	}
+
+	n := t.root
+	for {
+		d := damerauLevenshtein(term, n.term)
+		if d == 0 {
+			n.owners = append(n.owners, k)
+			return
+		}
+		child, ok := n.children[d]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[int]*bkNode)
+			}
+			n.children[d] = &bkNode{term: term, owners: []int{k}}
+			return
+		}
+		n = child
+	}
+}
+
+// search calls found with the owners of every term within the tree's
+// radius of term, and the distance to it
+func (t *bkTree) search(term []rune, found func(owners []int, d int)) {
+	if t.root == nil {
+		return
+	}
+	stack := []*bkNode{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := damerauLevenshtein(term, n.term)
+		if d <= t.radius {
+			found(n.owners, d)
+		}
+		for cd, child := range n.children {
+			if cd >= d-t.radius && cd <= d+t.radius {
+				stack = append(stack, child)
+			}
+		}
+	}
+}
+
+// damerauLevenshtein returns the number of insertions, deletions,
+// substitutions and transpositions of adjacent runes needed to turn a
+// into b. Unlike the restricted variant, which does not allow editing a
+// transposed pair again, this is a metric, as BK-trees require.
+func damerauLevenshtein(a, b []rune) int {
+	// Lowrance-Wagner: d[i+1][j+1] is the distance between a[:i] and
+	// b[:j], with an extra first row and column of "infinity"
+	inf := len(a) + len(b)
+	w := len(b) + 2
+	d := make([]int, (len(a)+2)*w)
+	d[0] = inf
+	for i := 0; i <= len(a); i++ {
+		d[(i+1)*w] = inf
+		d[(i+1)*w+1] = i
+	}
+	for j := 0; j <= len(b); j++ {
+		d[j+1] = inf
+		d[w+j+1] = j
+	}
+
+	last := make(map[rune]int) // last row in which each rune of a was seen
+	for i := 1; i <= len(a); i++ {
+		lastCol := 0 // last column in this row where a[i-1] == b[j-1]
+		for j := 1; j <= len(b); j++ {
+			k := last[b[j-1]]
+			l := lastCol
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+				lastCol = j
+			}
+			d[(i+1)*w+j+1] = min(
+				d[i*w+j]+cost,              // substitution
+				d[(i+1)*w+j]+1,             // insertion
+				d[i*w+j+1]+1,               // deletion
+				d[k*w+l]+(i-k-1)+1+(j-l-1), // transposition
+			)
+		}
+		last[a[i-1]] = i
+	}
+	return d[(len(a)+1)*w+len(b)+1]
+}
@@ -0,0 +1,236 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// Signal names raised by Heuristics
+const (
+	SignalEmoji       = "emoji"        // mostly emoji
+	SignalCaps        = "caps"         // mostly upper case letters
+	SignalRepetition  = "repetition"   // the same word or character many times in a row
+	SignalLowEntropy  = "low_entropy"  // very few distinct characters
+	SignalLong        = "long"         // very long
+	SignalShort       = "short"        // very short
+	SignalMixedScript = "mixed_script" // a word mixes look-alike scripts, like Latin and Cyrillic
+)
+
+// Signal is a property of a comment detected by a heuristic, with the
+// measured value that raised it
+type Signal struct {
+	Name  string
+	Value float64
+}
+
+// String formats a signal for logs: "caps=0.92"
+func (s Signal) String() string {
+	return fmt.Sprintf("%s=%.3g", s.Name, s.Value)
+}
+
+// Heuristics detect low-quality comments that no keyword describes. A
+// zero threshold disables its heuristic. The ratio and entropy checks
+// only apply to comments with at least MinRunes visible characters, so
+// that "OK" is not shouting and "🔥" is not a wall of emoji.
+type Heuristics struct {
+	EmojiRatio float64 `yaml:"emoji_ratio" json:"emoji_ratio"` // emoji among visible characters, 0-1
+	CapsRatio  float64 `yaml:"caps_ratio" json:"caps_ratio"`   // upper case among cased letters, 0-1
+	MaxRun     int     `yaml:"max_run" json:"max_run"`         // longest allowed run of one word or character
+	MinEntropy float64 `yaml:"min_entropy" json:"min_entropy"` // bits per character
+	MaxLength  int     `yaml:"max_length" json:"max_length"`   // in characters
+	MinLength  int     `yaml:"min_length" json:"min_length"`   // in visible characters
+	MinRunes   int     `yaml:"min_runes" json:"min_runes"`     // default 10
+
+	MixedScript bool `yaml:"mixed_script" json:"mixed_script"` // flag words like "PаyPal" with a Cyrillic "а"
+}
+
+// enabled reports whether the heuristic raising signal is enabled
+func (h *Heuristics) enabled(signal string) bool {
+	switch signal {
+	case SignalEmoji:
+		return h.EmojiRatio > 0
+	case SignalCaps:
+		return h.CapsRatio > 0
+	case SignalRepetition:
+		return h.MaxRun > 0
+	case SignalLowEntropy:
+		return h.MinEntropy > 0
+	case SignalLong:
+		return h.MaxLength > 0
+	case SignalShort:
+		return h.MinLength > 0
+	case SignalMixedScript:
+		return h.MixedScript
+	}
+	return false
+}
+
+// isSignal reports whether name is a known signal
+func isSignal(name string) bool {
+	switch name {
+	case SignalEmoji, SignalCaps, SignalRepetition, SignalLowEntropy, SignalLong, SignalShort, SignalMixedScript:
+		return true
+	}
+	return false
+}
+
+// Detect returns the signals raised by the normalized text of a comment
+func (h *Heuristics) Detect(text Normalized) []Signal {
+	var signals []Signal
+	raise := func(name string, value float64) {
+		signals = append(signals, Signal{Name: name, Value: value})
+	}
+
+	var runes, visible, emoji, upper, cased int
+	counts := make(map[rune]int)
+	for _, r := range text.Text {
+		runes++
+		if unicode.IsSpace(r) {
+			continue
+		}
+		visible++
+		counts[ahocorasick.FoldRune(r)]++
+		switch {
+		case isEmoji(r):
+			emoji++
+		case unicode.IsUpper(r):
+			upper++
+			cased++
+		case unicode.IsLower(r):
+			cased++
+		}
+	}
+
+	minRunes := h.MinRunes
+	if minRunes == 0 {
+		minRunes = 10
+	}
+	if visible >= minRunes {
+		if h.EmojiRatio > 0 {
+			if ratio := float64(emoji) / float64(visible); ratio >= h.EmojiRatio {
+				raise(SignalEmoji, ratio)
+			}
+		}
+		if h.CapsRatio > 0 && cased >= minRunes {
+			if ratio := float64(upper) / float64(cased); ratio >= h.CapsRatio {
+				raise(SignalCaps, ratio)
+			}
+		}
+		if h.MinEntropy > 0 {
+			if e := entropy(counts, visible); e < h.MinEntropy {
+				raise(SignalLowEntropy, e)
+			}
+		}
+	}
+	if h.MaxRun > 0 {
+		if run := longestRun(text.Text); run > h.MaxRun {
+			raise(SignalRepetition, float64(run))
+		}
+	}
+	if h.MaxLength > 0 && runes > h.MaxLength {
+		raise(SignalLong, float64(runes))
+	}
+	if h.MinLength > 0 && visible < h.MinLength {
+		raise(SignalShort, float64(visible))
+	}
+	if h.MixedScript {
+		// Normalization maps look-alike letters to Latin, so this looks
+		// at the text as written
+		if words := mixedScriptWords(text.original); len(words) > 0 {
+			raise(SignalMixedScript, float64(len(words)))
+		}
+	}
+	return signals
+}
+
+// isEmoji reports whether r is an emoji or pictograph
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // pictographs, emoticons, flags
+		r >= 0x2600 && r <= 0x27BF, // miscellaneous symbols, dingbats
+		r >= 0x2B00 && r <= 0x2BFF: // arrows, stars
+		return true
+	}
+	return false
+}
+
+// entropy returns the Shannon entropy, in bits per character, of a text
+// of n characters with the given character counts
+func entropy(counts map[rune]int, n int) float64 {
+	var e float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// longestRun returns the length of the longest run of the same word, or
+// of the same character, in text. Case is ignored.
+func longestRun(text string) int {
+	longest, run := 0, 0
+	prev := rune(-1)
+	for _, r := range text {
+		r = ahocorasick.FoldRune(r)
+		if r == prev {
+			run++
+		} else {
+			prev, run = r, 1
+		}
+		longest = max(longest, run)
+	}
+
+	words := strings.FieldsFunc(text, func(r rune) bool { return !isWordRune(r) && !isEmoji(r) })
+	run = 0
+	for i, w := range words {
+		if i > 0 && ahocorasick.Fold(w) == ahocorasick.Fold(words[i-1]) {
+			run++
+		} else {
+			run = 1
+		}
+		longest = max(longest, run)
+	}
+	return longest
+}
+
+// signalHits gates the hits of rules with signals, and adds a hit for
+// every rule whose signals are all raised: it drops hits of rules that
+// need a signal that was not raised, and adds a hit without a span for
+// every other rule with signals that has either hits or no patterns.
+func signalHits(hits []Hit, rules []*Rule, signals []Signal) []Hit {
+	raised := make(map[string]bool)
+	for _, s := range signals {
+		raised[s.Name] = true
+	}
+	active := func(r *Rule) bool {
+		for _, name := range r.Signals {
+			if !raised[name] {
+				return false
+			}
+		}
+		return true
+	}
+
+	kept := hits[:0]
+	for _, h := range hits {
+		if active(h.Rule) {
+			kept = append(kept, h)
+		}
+	}
+	hits = kept
+
+	for _, r := range rules {
+		if !active(r) || (len(r.Patterns) > 0 || len(r.Regexes) > 0) && !hasRule(hits, r) {
+			continue
+		}
+		names := append([]string(nil), r.Signals...)
+		sort.Strings(names)
+		hits = append(hits, Hit{Word: "[" + strings.Join(names, "+") + "]", Rule: r, Weight: r.weight()})
+	}
+	return hits
+}
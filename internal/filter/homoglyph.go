@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// homoglyphScripts are the scripts whose letters look like each other
+// ("а" and "a", "Η" and "H"). A word mixing two of them is almost always
+// written to fool filters or readers; mixing, say, Latin and Japanese is
+// ordinary text.
+var homoglyphScripts = []*unicode.RangeTable{
+	unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Armenian, unicode.Cherokee,
+}
+
+// mixedScriptWords returns the words of text that mix letters of
+// several homoglyph scripts, like "PаyPal" with a Cyrillic "а"
+func mixedScriptWords(text string) []string {
+	var mixed []string
+	words := strings.FieldsFunc(text, func(r rune) bool { return !isWordRune(r) && !invisible(r) })
+	for _, w := range words {
+		var seen *unicode.RangeTable
+		for _, r := range w {
+			t := homoglyphScript(r)
+			if t == nil {
+				continue
+			}
+			if seen != nil && t != seen {
+				mixed = append(mixed, w)
+				break
+			}
+			seen = t
+		}
+	}
+	return mixed
+}
+
+// homoglyphScript returns the homoglyph script of a letter, or nil
+func homoglyphScript(r rune) *unicode.RangeTable {
+	if r < utf8.RuneSelf {
+		if unicode.IsLetter(r) {
+			return unicode.Latin
+		}
+		return nil
+	}
+	for _, t := range homoglyphScripts {
+		if unicode.Is(t, r) {
+			return t
+		}
+	}
+	return nil
+}
+
+// skeletonRunes maps characters that are confusable with a letter once
+// case is folded: "PayPaI" reads as "PayPal", "G00gle" as "Google"
+var skeletonRunes = map[rune]rune{
+	'0': 'o', '1': 'l', 'i': 'l', '|': 'l', '@': 'a', '$': 's',
+}
+
+// skeletonPairs are letter pairs that read as a single letter
+var skeletonPairs = strings.NewReplacer("rn", "m", "vv", "w")
+
+// skeleton reduces s to the form two confusable strings share: it is
+// normalized (see Normalize), case folded, confusable characters are
+// mapped to one representative and everything but letters and digits is
+// dropped, so "PayPaI", "Pay Pal" and "ΡayΡal" have the same skeleton.
+func skeleton(s string) string {
+	var b strings.Builder
+	for _, r := range Normalize(s).Text {
+		r = ahocorasick.FoldRune(r)
+		if c, ok := skeletonRunes[r]; ok {
+			r = c
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return skeletonPairs.Replace(b.String())
+}
+
+// plain reduces s to its case folded letters and digits, as written
+func plain(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(ahocorasick.FoldRune(r))
+		}
+	}
+	return b.String()
+}
+
+// protectedTerms finds imitations of protected names, like the channel's
+// own name, its sponsors or "YouTube": text that has the skeleton of a
+// protected term but is not written like it.
+type protectedTerms struct {
+	terms    map[string]string // skeleton → term
+	maxWords int               // words in the longest term
+	rule     *Rule             // rule of the hits
+}
+
+// newProtectedTerms builds protectedTerms. Hits get action, or the
+// default action if it is "".
+func newProtectedTerms(terms []string, action Action) *protectedTerms {
+	rule := impersonation
+	rule.Action = action
+	p := &protectedTerms{terms: make(map[string]string), rule: &rule}
+	for _, t := range terms {
+		sk := skeleton(t)
+		if sk == "" {
+			continue
+		}
+		p.terms[sk] = t
+		p.maxWords = max(p.maxWords, len(strings.Fields(t)))
+	}
+	return p
+}
+
+// impersonation is the rule of hits for imitated protected terms
+var impersonation = Rule{Name: "impersonation", Category: "impersonation", Severity: SeverityHigh}
+
+// find returns a hit for every imitation of a protected term in text.
+// Terms are looked for in runs of up to as many words as the longest
+// term has, so "Linus Tech Tips" is found as "LinusTechTips" too.
+func (p *protectedTerms) find(text string) []Hit {
+	if len(p.terms) == 0 {
+		return nil
+	}
+
+	type field struct{ start, end int }
+	var fields []field
+	start := -1
+	for i, r := range text {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				fields = append(fields, field{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, field{start, len(text)})
+	}
+
+	var hits []Hit
+	for i := 0; i < len(fields); i++ {
+		for n := 1; n <= p.maxWords && i+n <= len(fields); n++ {
+			written := text[fields[i].start:fields[i+n-1].end]
+			term, ok := p.terms[skeleton(written)]
+			if !ok {
+				continue
+			}
+			if plain(written) != plain(term) {
+				hits = append(hits, Hit{Word: term, Start: fields[i].start, End: fields[i+n-1].end, Rule: p.rule, Weight: p.rule.weight()})
+			}
+			i += n - 1
+			break
+		}
+	}
+	return hits
+}
@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchMode controls where in a comment a keyword may match
+type MatchMode int
+
+const (
+	// ModeSubstring matches the keyword anywhere, even inside other words
+	ModeSubstring MatchMode = iota
+	// ModeWord matches the keyword only as a whole word
+	ModeWord
+	// ModePrefix matches the keyword only at the start of a word
+	ModePrefix
+)
+
+// String returns the name used for the mode in keyword files
+func (m MatchMode) String() string {
+	switch m {
+	case ModeWord:
+		return "word"
+	case ModePrefix:
+		return "prefix"
+	default:
+		return "substring"
+	}
+}
+
+// Keyword is a single banned phrase and the options it was declared with
+type Keyword struct {
+	Text string
+	Mode MatchMode
+	Leet bool // match against canonical text, see Normalized.Canonical
+
+	// Fuzzy is the largest edit distance at which the keyword still
+	// matches a misspelled word, or 0 for exact matching
+	Fuzzy int
+
+	// Weight is added to the comment's score when the keyword is found,
+	// see Scorer. Zero means the weight of the rule, or 1.
+	Weight float64
+
+	// Rule the keyword belongs to, nil for the plain keyword list
+	Rule *Rule
+}
+
+// ParseKeyword parses one line of a keyword file. A line is the phrase,
+// optionally followed by "|" and a list of options:
+//
+//	crypto
+//	ass | word
+//	scam | prefix
+//	free gift | leet
+//	scam | word, leet
+//	giveaway | fuzzy
+//	cryptocurrency | fuzzy=2
+//	bitcoin | weight=0.5
+//
+// Without options a keyword matches as a substring of the normalized
+// text. The leet option also tolerates leetspeak, interleaved
+// punctuation and repeated letters; since that makes short keywords
+// match inside many innocent words ("free" in "fresh"), leet keywords
+// match whole words unless a mode is given. The fuzzy option matches whole
+// words within an edit distance (1 unless given), so that "crytpo" or
+// "giveawey" still match. The weight option sets how much the keyword
+// adds to a comment's score.
+func ParseKeyword(line string) (Keyword, error) {
+	text, opts, _ := strings.Cut(line, "|")
+	kw := Keyword{Text: strings.TrimSpace(text)}
+	if kw.Text == "" {
+		return kw, fmt.Errorf("empty keyword in %q", line)
+	}
+
+	modeSet := false
+	for _, opt := range strings.FieldsFunc(opts, isOptionSep) {
+		switch strings.ToLower(opt) {
+		case "substring":
+			kw.Mode, modeSet = ModeSubstring, true
+		case "word":
+			kw.Mode, modeSet = ModeWord, true
+		case "prefix":
+			kw.Mode, modeSet = ModePrefix, true
+		case "leet":
+			kw.Leet = true
+		case "fuzzy":
+			kw.Fuzzy = 1
+		default:
+			name, value, _ := strings.Cut(opt, "=")
+			switch strings.ToLower(name) {
+			case "fuzzy":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return kw, fmt.Errorf("invalid fuzzy distance %q for keyword %q", value, kw.Text)
+				}
+				kw.Fuzzy = n
+			case "weight":
+				w, err := strconv.ParseFloat(value, 64)
+				if err != nil || !(w > 0) || math.IsInf(w, 0) {
+					return kw, fmt.Errorf("invalid weight %q for keyword %q", value, kw.Text)
+				}
+				kw.Weight = w
+			default:
+				return kw, fmt.Errorf("unknown option %q for keyword %q", opt, kw.Text)
+			}
+		}
+	}
+
+	if kw.Leet && !modeSet {
+		kw.Mode = ModeWord
+	}
+	if kw.Fuzzy > 0 {
+		if kw.Mode == ModePrefix {
+			return kw, fmt.Errorf("fuzzy keyword %q cannot use prefix mode", kw.Text)
+		}
+		kw.Mode = ModeWord
+	}
+	return kw, nil
+}
+
+// weight returns the weight the keyword adds to a score
+func (k Keyword) weight() float64 {
+	if k.Weight > 0 {
+		return k.Weight
+	}
+	return k.Rule.weight()
+}
+
+// isOptionSep reports whether r separates keyword options
+func isOptionSep(r rune) bool {
+	return r == ',' || unicode.IsSpace(r)
+}
+
+// accepts reports whether a hit on [start, end) of the scanned text
+// satisfies the keyword's match mode. Boundaries are only required on
+// the sides where the keyword itself starts or ends with a word
+// character, the same way \b works in regular expressions.
+func (k Keyword) accepts(text string, start, end int) bool {
+	if k.Mode == ModeSubstring {
+		return true
+	}
+
+	first, _ := utf8.DecodeRuneInString(text[start:end])
+	if isWordRune(first) && !wordBoundary(text, start) {
+		return false
+	}
+	if k.Mode == ModePrefix {
+		return true
+	}
+
+	last, _ := utf8.DecodeLastRuneInString(text[start:end])
+	return !isWordRune(last) || wordBoundary(text, end)
+}
+
+// wordBoundary reports whether offset i in text sits between a word
+// character and a non-word character (or the start/end of the text)
+func wordBoundary(text string, i int) bool {
+	before, after := false, false
+	if i > 0 {
+		r, _ := utf8.DecodeLastRuneInString(text[:i])
+		before = isWordRune(r)
+	}
+	if i < len(text) {
+		r, _ := utf8.DecodeRuneInString(text[i:])
+		after = isWordRune(r)
+	}
+	return before != after
+}
+
+// isWordRune reports whether r is part of a word: any Unicode letter,
+// digit or combining mark, and the underscore
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
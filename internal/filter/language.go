@@ -0,0 +1,188 @@
+package filter
+
+import (
+	"embed"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// langdata holds a sample text per language, named after its ISO 639-1
+// code. A language may have several samples, one per script or spelling
+// ("hi-latn.txt" is Hindi written in Latin letters).
+//
+//go:embed langdata/*.txt
+var langdata embed.FS
+
+const (
+	// maxGram is the length of the longest character n-grams compared
+	maxGram = 3
+
+	// minLetters is the number of letters below which a text is too
+	// short to tell its language
+	minLetters = 6
+
+	// minMargin is how much more likely, in log probability per n-gram,
+	// the best language must be than the runner-up
+	minMargin = 0.15
+)
+
+// languageProfile holds the log probabilities of the character n-grams
+// of a language sample
+type languageProfile struct {
+	lang   string
+	logp   map[string]float64
+	unseen float64 // log probability of n-grams not in the sample
+}
+
+// languageProfiles are built from langdata once, when first needed
+var languageProfiles = sync.OnceValue(func() []*languageProfile {
+	entries, err := langdata.ReadDir("langdata")
+	if err != nil {
+		panic(err)
+	}
+
+	var profiles []*languageProfile
+	var counts []map[string]int
+	vocabulary := make(map[string]bool) // distinct n-grams of all samples
+	for _, e := range entries {
+		data, err := langdata.ReadFile(path.Join("langdata", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		lang, _, _ := strings.Cut(strings.TrimSuffix(e.Name(), ".txt"), "-")
+		c := make(map[string]int)
+		for _, g := range ngrams(string(data)) {
+			c[g]++
+			vocabulary[g] = true
+		}
+		profiles = append(profiles, &languageProfile{lang: lang})
+		counts = append(counts, c)
+	}
+
+	// Add-one smoothing, so that n-grams a sample lacks do not rule out
+	// its language
+	for i, p := range profiles {
+		total := 0
+		for _, n := range counts[i] {
+			total += n
+		}
+		denom := math.Log(float64(total + len(vocabulary)))
+		p.unseen = -denom
+		p.logp = make(map[string]float64, len(counts[i]))
+		for g, n := range counts[i] {
+			p.logp[g] = math.Log(float64(n+1)) - denom
+		}
+	}
+	return profiles
+})
+
+// Languages lists the codes of the languages DetectLanguage knows
+func Languages() []string {
+	var langs []string
+	for _, p := range languageProfiles() {
+		if len(langs) == 0 || langs[len(langs)-1] != p.lang {
+			langs = append(langs, p.lang)
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// knownLanguage reports whether DetectLanguage can detect lang
+func knownLanguage(lang string) bool {
+	return slices.Contains(Languages(), lang)
+}
+
+// DetectLanguage returns the ISO 639-1 code of the language text is
+// written in ("en", "es", "pt", "hi"), or "" if the text is too short or
+// does not clearly belong to one of them. It compares the character
+// n-grams of text with those of built-in samples of every language, so
+// it works offline and takes well under a millisecond, but needs a few
+// words to be reliable.
+func DetectLanguage(text string) string {
+	grams := ngrams(text)
+	letters := 0
+	for _, g := range grams {
+		if len([]rune(g)) == 1 {
+			letters++
+		}
+	}
+	if letters < minLetters {
+		return ""
+	}
+
+	best := make(map[string]float64) // best score of each language
+	for _, p := range languageProfiles() {
+		var score float64
+		for _, g := range grams {
+			if lp, ok := p.logp[g]; ok {
+				score += lp
+			} else {
+				score += p.unseen
+			}
+		}
+		if s, ok := best[p.lang]; !ok || score > s {
+			best[p.lang] = score
+		}
+	}
+
+	first, second := "", math.Inf(-1)
+	for lang, score := range best {
+		switch {
+		case first == "" || score > best[first]:
+			if first != "" {
+				second = best[first]
+			}
+			first = lang
+		case score > second:
+			second = score
+		}
+	}
+	if (best[first]-second)/float64(len(grams)) < minMargin {
+		return ""
+	}
+	return first
+}
+
+// ngrams returns the character n-grams of every word of text, up to
+// maxGram long, after normalization and case folding. Words are padded
+// with a space, so that n-grams at the start and end of words count
+// separately ("the" gives " t", "he ", " th"...). Single letters are
+// included, but not the lone padding.
+func ngrams(text string) []string {
+	var grams []string
+	words := strings.FieldsFunc(Normalize(text).Text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsMark(r)
+	})
+	for _, w := range words {
+		runes := []rune(" " + ahocorasick.Fold(w) + " ")
+		for n := 1; n <= maxGram; n++ {
+			for i := 0; i+n <= len(runes); i++ {
+				if n == 1 && runes[i] == ' ' {
+					continue
+				}
+				grams = append(grams, string(runes[i:i+n]))
+			}
+		}
+	}
+	return grams
+}
+
+// inLanguage drops the hits of rules restricted to other languages than
+// lang. Hits of such rules are all dropped if lang is "".
+func inLanguage(hits []Hit, lang string) []Hit {
+	kept := hits[:0]
+	for _, h := range hits {
+		if len(h.Rule.Languages) == 0 || lang != "" && slices.Contains(h.Rule.Languages, lang) {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,303 @@
+package filter
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// LinkKind classifies well-known hosts that spammers favor
+type LinkKind string
+
+const (
+	// LinkShortener is a URL shortener, which hides the real target
+	LinkShortener LinkKind = "shortener"
+	// LinkInvite is a messenger or chat invite (Telegram, WhatsApp, Discord)
+	LinkInvite LinkKind = "invite"
+)
+
+// Link is a link found in a comment. Start and End are byte offsets into
+// the original comment text; the <a href> targets Matcher.CheckComment
+// adds have no span (Start == End).
+type Link struct {
+	Host       string // as written, lower case, without "www."
+	URL        string // the link as written, or the href target
+	Path       string // path of the URL, "" if it has none
+	Start      int
+	End        int
+	Obfuscated bool     // written as "example dot com", "example[.]com", "еxample.com"...
+	Kind       LinkKind // "" for other hosts
+	// Lookalike is the host a host written with look-alike letters
+	// imitates, "paypal.com" for the Cyrillic "раураl.com". It is "" for
+	// hosts written plainly.
+	Lookalike string
+}
+
+var (
+	shorteners = newDomainList(
+		"bit.ly", "tinyurl.com", "goo.gl", "t.co", "ow.ly", "is.gd", "buff.ly",
+		"cutt.ly", "rebrand.ly", "shorturl.at", "tiny.cc", "rb.gy", "s.id", "v.gd",
+	)
+	invites = newDomainList(
+		"t.me", "telegram.me", "telegram.dog", "wa.me", "chat.whatsapp.com",
+		"discord.gg", "discord.com/invite",
+	)
+
+	// tlds are the top level domains a bare, scheme-less domain must end
+	// in to count as a link, so that "end.of sentence" is not one
+	tlds = map[string]bool{
+		"com": true, "net": true, "org": true, "info": true, "biz": true, "io": true,
+		"me": true, "ly": true, "gg": true, "co": true, "xyz": true, "top": true,
+		"app": true, "dev": true, "link": true, "site": true, "online": true,
+		"club": true, "shop": true, "store": true, "live": true, "tv": true,
+		"cc": true, "to": true, "ru": true, "tk": true, "ml": true, "ga": true,
+		"cf": true, "gq": true, "us": true, "uk": true, "de": true, "fr": true,
+		"in": true, "id": true, "at": true, "gd": true, "click": true, "vip": true,
+		"win": true, "bet": true, "fun": true, "icu": true, "pw": true,
+	}
+
+	// proseWords are words that come before "dot com" in ordinary
+	// sentences ("the whole dot com era") and are not taken for the name
+	// of a spelled-out domain
+	proseWords = map[string]bool{
+		"about": true, "also": true, "entire": true, "even": true, "from": true,
+		"have": true, "into": true, "just": true, "like": true, "more": true,
+		"only": true, "over": true, "said": true, "says": true, "some": true,
+		"than": true, "that": true, "their": true, "then": true, "there": true,
+		"this": true, "very": true, "what": true, "when": true, "where": true,
+		"which": true, "whole": true, "with": true, "your": true,
+	}
+)
+
+var (
+	// hrefPattern finds the targets of <a href> markup in TextDisplay
+	hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*?href\s*=\s*["']([^"']*)["']`)
+	// tagPattern finds markup, which is blanked out before scanning text
+	tagPattern = regexp.MustCompile(`<[^<>]*>`)
+
+	// linkSep is a dot between labels: ".", "[.]", "(dot)", " dot "
+	linkSep   = `(?:\.|\s*[\[\(\{]\s*(?:\.|dot)\s*[\]\)\}]\s*|\s+dot\s+)`
+	linkLabel = `[\p{L}\p{N}](?:[\p{L}\p{N}-]*[\p{L}\p{N}])?`
+
+	// linkPattern finds links in text, with an optional scheme (also
+	// the defanged "hxxp"), the host and an optional path
+	linkPattern = regexp.MustCompile(`(?i)(h[tx]{2}ps?://)?(` + linkLabel + `(?:` + linkSep + linkLabel + `)+)(/[^\s<>"']*)?`)
+	sepPattern  = regexp.MustCompile(`(?i)` + linkSep)
+)
+
+// ExtractLinks returns the links in a comment: the targets of <a href>
+// markup and every URL or domain in the text, including obfuscated ones
+// like "example dot com" or "example[.]com". Domains without a scheme
+// only count if they end in a common top level domain. Hosts are found
+// in the normalized text, but kept as written: one that only reads as a
+// known domain once normalized is a different domain, see Link.Lookalike.
+func ExtractLinks(text string) []Link {
+	links := hrefLinks(text)
+
+	// Blank out markup, keeping offsets, so that only the visible text is
+	// scanned below
+	masked := tagPattern.ReplaceAllStringFunc(text, func(tag string) string {
+		return strings.Repeat(" ", len(tag))
+	})
+	norm := Normalize(masked)
+	for _, m := range linkPattern.FindAllStringSubmatchIndex(norm.Text, -1) {
+		if m[0] > 0 {
+			// Part of a longer word, or an e-mail address
+			r, _ := utf8.DecodeLastRuneInString(norm.Text[:m[0]])
+			if isWordRune(r) || r == '@' {
+				continue
+			}
+		}
+
+		rawHost := norm.Text[m[4]:m[5]]
+		labels := sepPattern.Split(rawHost, -1)
+		if m[2] < 0 && (!tlds[strings.ToLower(labels[len(labels)-1])] || !plausibleSpelling(rawHost, labels)) {
+			continue
+		}
+		if m[2] >= 0 && len(labels[len(labels)-1]) < 2 {
+			continue
+		}
+
+		var path string
+		if m[6] >= 0 {
+			path = norm.Text[m[6]:m[7]]
+		}
+		start, end := norm.Span(m[0], m[1])
+		hostStart, hostEnd := norm.Span(m[4], m[5])
+		host := writtenHost(text[hostStart:hostEnd])
+		links = append(links, newLink(host, path, text[start:end], start, end, strings.Join(labels, ".") != rawHost))
+	}
+	return links
+}
+
+// writtenHost returns a host as written, with the dots between its
+// labels however they were spelled. Only compatibility forms such as
+// fullwidth letters are folded, as browsers do; look-alike letters from
+// other scripts are kept.
+func writtenHost(raw string) string {
+	return strings.Join(sepPattern.Split(norm.NFKC.String(raw), -1), ".")
+}
+
+// plausibleSpelling reports whether a host with a spelled-out " dot "
+// separator looks like a disguised domain rather than prose: the label
+// before every such separator must be "www", or a name of at least four
+// letters that is not a common word. "example dot com" passes, "the dot
+// com bubble" and "said hi dot com" do not.
+func plausibleSpelling(rawHost string, labels []string) bool {
+	for i, sep := range sepPattern.FindAllString(rawHost, -1) {
+		if !strings.EqualFold(strings.TrimSpace(sep), "dot") {
+			continue
+		}
+		label := strings.ToLower(labels[i])
+		if label != "www" && (utf8.RuneCountInString(label) < 4 || proseWords[label]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hrefLinks returns the targets of the <a href> markup in text
+func hrefLinks(text string) []Link {
+	var links []Link
+	for _, m := range hrefPattern.FindAllStringSubmatchIndex(text, -1) {
+		target := unwrapRedirect(html.UnescapeString(text[m[2]:m[3]]))
+		u, err := url.Parse(target)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		links = append(links, newLink(u.Hostname(), u.Path, target, m[2], m[3], false))
+	}
+	return links
+}
+
+// newLink builds a Link, normalizing its host and classifying it. A host
+// that normalizes to another one is a look-alike of it.
+func newLink(host, path, raw string, start, end int, obfuscated bool) Link {
+	host = cleanHost(host)
+	l := Link{Host: host, URL: raw, Path: path, Start: start, End: end, Obfuscated: obfuscated}
+	if latin := cleanHost(Normalize(host).Text); latin != host {
+		l.Lookalike, l.Obfuscated = latin, true
+	}
+	switch {
+	case shorteners.matches(host, path):
+		l.Kind = LinkShortener
+	case invites.matches(host, path):
+		l.Kind = LinkInvite
+	}
+	return l
+}
+
+// cleanHost lower cases a host and drops its "www." and trailing dot
+func cleanHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.TrimPrefix(host, "www.")
+}
+
+// unwrapRedirect returns the target of a YouTube redirect link, which is
+// how TextDisplay renders external links, or target itself
+func unwrapRedirect(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == "youtube.com" && u.Path == "/redirect" {
+		if q := u.Query().Get("q"); q != "" {
+			return q
+		}
+	}
+	return target
+}
+
+// domainList is a set of domains, optionally with a path prefix
+// ("discord.com/invite"). A domain also matches all of its subdomains.
+type domainList map[string][]string
+
+// newDomainList builds a domainList from entries like "example.com" or
+// "example.com/path"
+func newDomainList(entries ...string) domainList {
+	l := make(domainList)
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		e = strings.TrimPrefix(strings.TrimPrefix(e, "https://"), "http://")
+		host, path, _ := strings.Cut(e, "/")
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*."), "www.")
+		if host == "" {
+			continue
+		}
+		if path != "" {
+			path = "/" + path
+		}
+		l[host] = append(l[host], path)
+	}
+	return l
+}
+
+// matches reports whether host, or one of its parent domains, is in the
+// list with a path prefix of path
+func (l domainList) matches(host, path string) bool {
+	for {
+		for _, prefix := range l[host] {
+			if strings.HasPrefix(strings.ToLower(path), prefix) {
+				return true
+			}
+		}
+		dot := strings.IndexByte(host, '.')
+		if dot < 0 {
+			return false
+		}
+		host = host[dot+1:]
+	}
+}
+
+// linkPolicy decides which links are allowed, and which are denied.
+// Every link that is not allowed counts for the non-subscriber link
+// action; denied links are also reported as hits.
+type linkPolicy struct {
+	allow     domainList
+	deny      domainList
+	denyKinds bool  // deny shorteners and invites too
+	rule      *Rule // rule of the hits for denied links
+}
+
+// newLinkPolicy builds a linkPolicy from allow and deny list entries.
+// With denyKinds, shorteners and invites are denied as well. Hits for
+// denied links get action, or the default action if it is "".
+func newLinkPolicy(allow, deny []string, denyKinds bool, action Action) *linkPolicy {
+	rule := deniedLinks
+	rule.Action = action
+	return &linkPolicy{allow: newDomainList(allow...), deny: newDomainList(deny...), denyKinds: denyKinds, rule: &rule}
+}
+
+// deniedLinks is the rule of hits for links to denied domains
+var deniedLinks = Rule{Name: "denied_domain", Category: "link", Severity: SeverityMedium}
+
+// allowed reports whether a link is on the allow list. YouTube's own
+// links, like timestamps, are always allowed. Look-alike hosts are
+// matched as written, so they never pass for the domain they imitate.
+func (p *linkPolicy) allowed(l Link) bool {
+	return youTubeHost(l.Host) || p.allow.matches(l.Host, l.Path)
+}
+
+// denied reports whether a link is denied: its domain is on the deny
+// list, or it is a shortener or an invite and those are denied, and it
+// is not allowed. A look-alike of an allowed or denied domain, or of
+// YouTube, is denied too.
+func (p *linkPolicy) denied(l Link) bool {
+	if p.allowed(l) {
+		return false
+	}
+	if l.Lookalike != "" && (youTubeHost(l.Lookalike) || p.allow.matches(l.Lookalike, l.Path) || p.deny.matches(l.Lookalike, l.Path)) {
+		return true
+	}
+	return p.denyKinds && l.Kind != "" || p.deny.matches(l.Host, l.Path)
+}
+
+// youTubeHost reports whether host is one of YouTube's own
+func youTubeHost(host string) bool {
+	return host == "youtube.com" || strings.HasSuffix(host, ".youtube.com") || host == "youtu.be"
+}
@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalized is comment or keyword text after normalization, together
+// with a map from every byte of the normalized text back to the rune
+// of the original text it came from.
+//
+// Normalization is applied rune by rune:
+//   - invisible format characters (zero-width spaces and joiners, soft
+//     hyphens, bidi controls, variation selectors) are removed;
+//   - the rune is decomposed with NFKD, which folds fullwidth, circled,
+//     mathematical and other compatibility forms to plain letters;
+//   - combining marks on Latin, Greek and Cyrillic letters are dropped,
+//     so "crýptô" becomes "crypto" (marks in other scripts carry
+//     meaning and are kept);
+//   - look-alike letters from other scripts are mapped to the Latin
+//     letter they imitate (Cyrillic "о" → "o", small capital "ᴄ" → "c").
+//
+// Case is left alone: the automaton folds case while it scans. Keywords
+// and comments go through the same steps, so they meet in the same form.
+type Normalized struct {
+	Text     string
+	original string
+	src      []int // offset in original of the rune behind each byte of Text
+}
+
+// Normalize runs the normalization pipeline over s
+func Normalize(s string) Normalized {
+	var b strings.Builder
+	b.Grow(len(s))
+	src := make([]int, 0, len(s))
+
+	var buf [utf8.UTFMax]byte
+	var decomposed []byte
+	base := unicode.Latin // script of the last base letter seen
+
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		n := b.Len()
+
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteByte(s[i])
+		case r < utf8.RuneSelf:
+			base = unicode.Latin
+			b.WriteByte(byte(r))
+		case invisible(r):
+			// dropped
+		default:
+			decomposed = norm.NFKD.Append(decomposed[:0], buf[:utf8.EncodeRune(buf[:], r)]...)
+			for j := 0; j < len(decomposed); {
+				d, dsize := utf8.DecodeRune(decomposed[j:])
+				j += dsize
+
+				if unicode.Is(unicode.Mn, d) {
+					if base == unicode.Latin || base == unicode.Greek || base == unicode.Cyrillic {
+						continue
+					}
+				} else {
+					base = scriptOf(d)
+				}
+
+				if c, ok := confusables[d]; ok {
+					d = c
+				}
+				b.WriteRune(d)
+			}
+		}
+
+		for j := n; j < b.Len(); j++ {
+			src = append(src, i)
+		}
+		i += size
+	}
+
+	return Normalized{Text: b.String(), original: s, src: src}
+}
+
+// Span maps the byte range [start, end) of the normalized text back to
+// the smallest byte range of the original text that produced it
+func (n Normalized) Span(start, end int) (int, int) {
+	if start >= end || end > len(n.src) {
+		return 0, 0
+	}
+	last := n.src[end-1]
+	_, size := utf8.DecodeRuneInString(n.original[last:])
+	return n.src[start], last + size
+}
+
+// invisible reports whether r renders as nothing and is only used to
+// split up words. Besides format characters this covers the blank
+// fillers (Hangul, Braille) that are popular for the same trick.
+func invisible(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Variation_Selector, r) ||
+		r == '\u034f' || r == '\u115f' || r == '\u1160' || r == '\u2800' || r == '\u3164' || r == '\uffa0'
+}
+
+// scriptOf returns the script of a letter, or nil for runes such as
+// digits and punctuation that are shared between scripts
+func scriptOf(r rune) *unicode.RangeTable {
+	if r < utf8.RuneSelf {
+		return unicode.Latin
+	}
+	for _, t := range []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Greek} {
+		if unicode.Is(t, r) {
+			return t
+		}
+	}
+	return nil
+}
+
+// confusables maps letters that are commonly used to imitate Latin
+// letters to the letter they imitate. Compatibility forms (fullwidth,
+// circled, mathematical) are already handled by NFKD and not listed.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'А': 'a', 'В': 'b', 'в': 'b', 'с': 'c', 'С': 'c', 'ԁ': 'd',
+	'е': 'e', 'Е': 'e', 'һ': 'h', 'Н': 'h', 'н': 'h', 'і': 'i',
+	'І': 'i', 'ј': 'j', 'Ј': 'j', 'к': 'k', 'К': 'k', 'ӏ': 'l', 'Ӏ': 'l',
+	'М': 'm', 'м': 'm', 'о': 'o', 'О': 'o', 'р': 'p', 'Р': 'p', 'ԛ': 'q',
+	'ѕ': 's', 'Ѕ': 's', 'Т': 't', 'т': 't', 'ѵ': 'v', 'ԝ': 'w',
+	'х': 'x', 'Х': 'x', 'у': 'y', 'У': 'y', 'ү': 'y',
+	// Greek
+	'α': 'a', 'Α': 'a', 'β': 'b', 'Β': 'b', 'ε': 'e', 'Ε': 'e', 'Η': 'h',
+	'ι': 'i', 'Ι': 'i', 'κ': 'k', 'Κ': 'k', 'Μ': 'm', 'ν': 'v', 'Ν': 'n',
+	'ο': 'o', 'Ο': 'o', 'ρ': 'p', 'Ρ': 'p', 'τ': 't', 'Τ': 't', 'υ': 'u',
+	'Υ': 'y', 'χ': 'x', 'Χ': 'x', 'Ζ': 'z',
+	// Latin letters outside ASCII
+	'ı': 'i', 'ɑ': 'a', 'ɡ': 'g', 'ɩ': 'i', 'ʋ': 'u',
+	// Small capitals
+	'ᴀ': 'a', 'ʙ': 'b', 'ᴄ': 'c', 'ᴅ': 'd', 'ᴇ': 'e', 'ꜰ': 'f', 'ɢ': 'g',
+	'ʜ': 'h', 'ɪ': 'i', 'ᴊ': 'j', 'ᴋ': 'k', 'ʟ': 'l', 'ᴍ': 'm', 'ɴ': 'n',
+	'ᴏ': 'o', 'ᴘ': 'p', 'ʀ': 'r', 'ꜱ': 's', 'ᴛ': 't', 'ᴜ': 'u', 'ᴠ': 'v',
+	'ᴡ': 'w', 'ʏ': 'y', 'ᴢ': 'z',
+}
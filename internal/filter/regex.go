@@ -0,0 +1,175 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+
+	"github.com/joshkleinlab/tubeguardian/internal/ahocorasick"
+)
+
+// regexPattern is a compiled regular expression of a rule
+type regexPattern struct {
+	source string
+	re     *regexp.Regexp
+	rule   *Rule
+}
+
+// ruleRegexes compiles the regular expressions of r
+func ruleRegexes(r *Rule) ([]regexPattern, error) {
+	var patterns []regexPattern
+	for _, src := range r.Regexes {
+		re, err := regexp.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		patterns = append(patterns, regexPattern{source: src, re: re, rule: r})
+	}
+	return patterns, nil
+}
+
+// regexSet runs a set of regular expressions over a comment. Running
+// hundreds of them on every comment would be slow, so each regex is
+// reduced to a few literal strings, one of which must occur in anything
+// it matches (for "t\.me/\w+bot", "t.me/"). An automaton finds the
+// literals in one pass, and only the regexes whose literals were found
+// are run. Regexes without usable literals ("\d{10}") always run.
+type regexSet struct {
+	patterns []regexPattern
+	ac       *ahocorasick.Matcher // literals of all patterns, folded
+	owners   [][]int              // patterns for each automaton literal
+	always   []int                // patterns without literals
+}
+
+// newRegexSet builds a regexSet, or returns nil if there are no patterns
+func newRegexSet(patterns []regexPattern) *regexSet {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	s := &regexSet{patterns: patterns}
+	var literals []string
+	index := make(map[string]int)
+	for i, p := range patterns {
+		lits := requiredLiterals(p.source)
+		if lits == nil {
+			s.always = append(s.always, i)
+			continue
+		}
+		for _, lit := range lits {
+			lit = ahocorasick.Fold(lit)
+			l, ok := index[lit]
+			if !ok {
+				l = len(literals)
+				index[lit] = l
+				literals = append(literals, lit)
+				s.owners = append(s.owners, nil)
+			}
+			s.owners[l] = append(s.owners[l], i)
+		}
+	}
+	if len(literals) > 0 {
+		s.ac = ahocorasick.NewFoldingMatcher(literals)
+	}
+	return s
+}
+
+// find runs the patterns whose literals occur in text and returns a hit
+// for every match
+func (s *regexSet) find(text Normalized) []Hit {
+	run := make([]bool, len(s.patterns))
+	for _, i := range s.always {
+		run[i] = true
+	}
+	if s.ac != nil {
+		for _, l := range s.ac.MatchThreadSafe([]byte(text.Text)) {
+			for _, i := range s.owners[l] {
+				run[i] = true
+			}
+		}
+	}
+
+	var hits []Hit
+	for i, p := range s.patterns {
+		if !run[i] {
+			continue
+		}
+		for _, loc := range p.re.FindAllStringIndex(text.Text, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			start, end := text.Span(loc[0], loc[1])
+			hits = append(hits, Hit{Word: p.source, Start: start, End: end, Rule: p.rule, Weight: p.rule.weight()})
+		}
+	}
+	return hits
+}
+
+// requiredLiterals returns strings one of which occurs in every match of
+// the regular expression src, or nil if there is no such set of
+// non-empty strings
+func requiredLiterals(src string) []string {
+	re, err := syntax.Parse(src, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return literals(re.Simplify())
+}
+
+// literals implements requiredLiterals on a parsed expression
+func literals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if len(re.Rune) == 0 {
+			return nil
+		}
+		if re.Flags&syntax.FoldCase != 0 {
+			return []string{ahocorasick.Fold(string(re.Rune))}
+		}
+		return []string{string(re.Rune)}
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return literals(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min == 0 {
+			return nil
+		}
+		return literals(re.Sub[0])
+
+	case syntax.OpAlternate:
+		var all []string
+		for _, sub := range re.Sub {
+			lits := literals(sub)
+			if lits == nil {
+				return nil
+			}
+			all = append(all, lits...)
+		}
+		return all
+
+	case syntax.OpConcat:
+		// Any sub-expression's literals will do; keep the set whose
+		// shortest literal is the longest, as it is the most selective
+		var best []string
+		for _, sub := range re.Sub {
+			if lits := literals(sub); lits != nil && shortest(lits) > shortest(best) {
+				best = lits
+			}
+		}
+		return best
+	}
+	return nil
+}
+
+// shortest returns the length of the shortest string in lits, or 0 if
+// lits is empty
+func shortest(lits []string) int {
+	n := 0
+	for i, l := range lits {
+		if i == 0 || len(l) < n {
+			n = len(l)
+		}
+	}
+	return n
+}
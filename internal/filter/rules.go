@@ -0,0 +1,279 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Action is what to do with a comment that matched a rule
+type Action string
+
+const (
+	// ActionLog only logs the comment
+	ActionLog Action = "log"
+	// ActionHold holds the comment for review
+	ActionHold Action = "hold"
+	// ActionReject rejects the comment
+	ActionReject Action = "reject"
+	// ActionBan rejects the comment and bans its author from the channel
+	ActionBan Action = "ban"
+)
+
+// ParseAction parses an action name. The YouTube moderation statuses
+// used by MODE_RATION ("heldForReview", "rejected") are accepted too.
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "log":
+		return ActionLog, nil
+	case "hold", "heldforreview":
+		return ActionHold, nil
+	case "reject", "rejected":
+		return ActionReject, nil
+	case "ban", "rejectandban":
+		return ActionBan, nil
+	}
+	return "", fmt.Errorf("unknown action %q", s)
+}
+
+// UnmarshalText lets rule files use any name accepted by ParseAction
+func (a *Action) UnmarshalText(text []byte) error {
+	parsed, err := ParseAction(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// strength orders actions from the mildest to the harshest
+func (a Action) strength() int {
+	switch a {
+	case ActionLog:
+		return 1
+	case ActionHold:
+		return 2
+	case ActionReject:
+		return 3
+	case ActionBan:
+		return 4
+	}
+	return 0
+}
+
+// Harsher returns the harsher of two actions
+func Harsher(a, b Action) Action {
+	if b.strength() > a.strength() {
+		return b
+	}
+	return a
+}
+
+// Severity ranks rules. When a comment matches several rules, the one
+// with the highest severity decides what happens to it.
+type Severity int
+
+const (
+	SeverityLow Severity = iota + 1
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = map[string]Severity{
+	"low":      SeverityLow,
+	"medium":   SeverityMedium,
+	"high":     SeverityHigh,
+	"critical": SeverityCritical,
+}
+
+// String returns the severity's name
+func (s Severity) String() string {
+	for name, v := range severityNames {
+		if v == s {
+			return name
+		}
+	}
+	return strconv.Itoa(int(s))
+}
+
+// UnmarshalText accepts a severity name or a positive number
+func (s *Severity) UnmarshalText(text []byte) error {
+	name := strings.ToLower(strings.TrimSpace(string(text)))
+	if v, ok := severityNames[name]; ok {
+		*s = v
+		return nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		*s = Severity(n)
+		return nil
+	}
+	return fmt.Errorf("unknown severity %q", text)
+}
+
+// Rule groups patterns that share a category, a severity and an action
+type Rule struct {
+	Name     string   `yaml:"name" json:"name"`
+	Category string   `yaml:"category" json:"category"`
+	Severity Severity `yaml:"severity" json:"severity"`
+	Action   Action   `yaml:"action" json:"action"`
+
+	// Weight is the default weight of the rule's patterns and regexes
+	// when scoring, see Scorer
+	Weight float64 `yaml:"weight" json:"weight"`
+
+	// Patterns use the keyword file syntax, see ParseKeyword
+	Patterns []string `yaml:"patterns" json:"patterns"`
+
+	// Regexes are regular expressions in Go syntax, matched against the
+	// normalized comment text
+	Regexes []string `yaml:"regexes" json:"regexes"`
+
+	// Signals name heuristics (see Heuristics) that must all be raised
+	// for the rule to match. A rule with only signals matches on them
+	// alone; a rule that also has patterns or regexes needs both.
+	Signals []string `yaml:"signals" json:"signals"`
+
+	// Languages restricts the rule to comments detected to be in one of
+	// these languages (see DetectLanguage). A rule without languages
+	// applies to every comment.
+	Languages []string `yaml:"languages" json:"languages"`
+}
+
+// ruleFile is the layout of a rules file
+type ruleFile struct {
+	Heuristics Heuristics `yaml:"heuristics" json:"heuristics"`
+	Rules      []Rule     `yaml:"rules" json:"rules"`
+}
+
+// LoadRules reads a rules file. Files ending in .json are read as JSON,
+// anything else as YAML:
+//
+//	rules:
+//	  - name: crypto-scam
+//	    category: scam
+//	    severity: high
+//	    action: reject
+//	    patterns:
+//	      - crypto giveaway
+//	      - elon | word
+//	    regexes:
+//	      - 'wa\.me/\d+'
+//
+// Rules without a severity are medium. Rules without an action use the
+// configured default moderation mode.
+func LoadRules(path string) ([]Rule, error) {
+	f, err := loadRuleFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.Rules, nil
+}
+
+// loadRuleFile implements LoadRules, also returning the heuristics the
+// file configures:
+//
+//	heuristics:
+//	  caps_ratio: 0.8
+//	rules:
+//	  - name: shouting
+//	    signals: [caps]
+//	    action: hold
+func loadRuleFile(path string) (*ruleFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f ruleFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(&f); err != nil && len(bytes.TrimSpace(data)) == 0 {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range f.Rules {
+		r := &f.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if r.Severity == 0 {
+			r.Severity = SeverityMedium
+		}
+		if r.Weight < 0 || math.IsInf(r.Weight, 0) || math.IsNaN(r.Weight) {
+			return nil, fmt.Errorf("%s: rule %q has an invalid weight", path, r.Name)
+		}
+		if len(r.Patterns) == 0 && len(r.Regexes) == 0 && len(r.Signals) == 0 {
+			return nil, fmt.Errorf("%s: rule %q has no patterns, regexes or signals", path, r.Name)
+		}
+		for _, s := range r.Signals {
+			if !isSignal(s) {
+				return nil, fmt.Errorf("%s: rule %q: unknown signal %q", path, r.Name, s)
+			}
+			if !f.Heuristics.enabled(s) {
+				return nil, fmt.Errorf("%s: rule %q: signal %q is not enabled in heuristics", path, r.Name, s)
+			}
+		}
+		for _, lang := range r.Languages {
+			if !knownLanguage(lang) {
+				return nil, fmt.Errorf("%s: rule %q: unknown language %q (known: %s)", path, r.Name, lang, strings.Join(Languages(), ", "))
+			}
+		}
+	}
+	return &f, nil
+}
+
+// ruleKeywords parses the patterns of r into keywords belonging to r
+func ruleKeywords(r *Rule) ([]Keyword, error) {
+	var keywords []Keyword
+	for _, p := range r.Patterns {
+		kw, err := ParseKeyword(p)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		kw.Rule = r
+		keywords = append(keywords, kw)
+	}
+	return keywords, nil
+}
+
+// outranks reports whether rule a should decide over rule b: higher
+// severity first, then the harsher action
+func outranks(a, b *Rule, defaultAction Action) bool {
+	if a.Severity != b.Severity {
+		return a.Severity > b.Severity
+	}
+	return a.action(defaultAction).strength() > b.action(defaultAction).strength()
+}
+
+// weight returns the rule's weight, or 1 if it has none
+func (r *Rule) weight() float64 {
+	if r == nil || r.Weight == 0 {
+		return 1
+	}
+	return r.Weight
+}
+
+// action returns the rule's action, or def if the rule has none
+func (r *Rule) action(def Action) Action {
+	if r.Action == "" {
+		return def
+	}
+	return r.Action
+}
@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scorer turns the hits of a comment into a score and the score into an
+// action. Every keyword found adds its weight once, however often it
+// occurs; a fuzzy match adds its weight divided by 1 + its edit
+// distance. A score of at least Reject rejects the comment, a score of
+// at least Hold holds it for review. A zero threshold is never reached.
+type Scorer struct {
+	Hold   float64
+	Reject float64
+}
+
+// Score is the score of a comment and how it was reached
+type Score struct {
+	Total float64
+	Parts []ScorePart
+}
+
+// ScorePart is what one keyword added to a score
+type ScorePart struct {
+	Word   string
+	Rule   *Rule
+	Count  int     // occurrences in the comment
+	Weight float64 // added to the total
+}
+
+// Score sums the weights of hits
+func (s *Scorer) Score(hits []Hit) Score {
+	type key struct {
+		word string
+		rule *Rule
+	}
+	var sc Score
+	index := make(map[key]int)
+	for _, h := range hits {
+		w := h.Weight / float64(1+h.Distance)
+		k := key{h.Word, h.Rule}
+		i, ok := index[k]
+		if !ok {
+			i = len(sc.Parts)
+			index[k] = i
+			sc.Parts = append(sc.Parts, ScorePart{Word: h.Word, Rule: h.Rule})
+		}
+		p := &sc.Parts[i]
+		p.Count++
+		p.Weight = max(p.Weight, w)
+	}
+	for _, p := range sc.Parts {
+		sc.Total += p.Weight
+	}
+	return sc
+}
+
+// Action returns the action a score calls for, or "" if it is below both
+// thresholds
+func (s *Scorer) Action(sc Score) Action {
+	switch {
+	case s.Reject > 0 && sc.Total >= s.Reject:
+		return ActionReject
+	case s.Hold > 0 && sc.Total >= s.Hold:
+		return ActionHold
+	}
+	return ""
+}
+
+// String formats the breakdown of a score for logs:
+// "2.5 = crypto 1.5 + scam 1 (×3)"
+func (sc Score) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%g", sc.Total)
+	for i, p := range sc.Parts {
+		if i == 0 {
+			b.WriteString(" = ")
+		} else {
+			b.WriteString(" + ")
+		}
+		fmt.Fprintf(&b, "%s %g", p.Word, p.Weight)
+		if p.Count > 1 {
+			fmt.Fprintf(&b, " (×%d)", p.Count)
+		}
+	}
+	return b.String()
+}
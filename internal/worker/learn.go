@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/classifier"
+	"github.com/joshkleinlab/tubeguardian/internal/filter"
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+)
+
+const (
+	// maxDecisions bounds the hidden comments awaiting review
+	maxDecisions = 5000
+	// decisionTTL is how long a hidden comment is awaited for review
+	decisionTTL = 7 * 24 * time.Hour
+	// reviewBatch is how many hidden comments are checked per poll, so
+	// that checks cost one API call
+	reviewBatch = 50
+)
+
+// decision is a comment the poller hid
+type decision struct {
+	text     string
+	parentID string // of replies, to look up their review
+	action   filter.Action
+	at       time.Time
+	checked  time.Time // last review check, zero if never
+}
+
+// remember records a comment the poller hid, so that the classifier can
+// learn from its review
+func (p *Poller) remember(c youtube.Comment, action filter.Action) {
+	if action != filter.ActionHold && action != filter.ActionReject {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.decisions) >= maxDecisions {
+		p.expireDecisions(time.Now())
+		if len(p.decisions) >= maxDecisions {
+			return
+		}
+	}
+	p.decisions[c.ID] = decision{text: c.PlainText(), parentID: c.ParentID, action: action, at: time.Now()}
+}
+
+// expireDecisions forgets the decisions that were not reviewed in time.
+// p.mu must be held.
+func (p *Poller) expireDecisions(now time.Time) {
+	for id, d := range p.decisions {
+		if now.Sub(d.at) > decisionTTL {
+			delete(p.decisions, id)
+		}
+	}
+}
+
+// learnFromReviews trains the model with what moderators decided about
+// the comments the poller hid: a comment they published was ham (the
+// poller was wrong), a held comment they rejected was spam. Replies can
+// only be learned as ham, see youtube.Client.ModerationStatuses. Each call
+// checks the reviewBatch comments checked least recently; those still
+// awaiting review are checked again later. The model is saved when it
+// learned something.
+func (p *Poller) learnFromReviews(ctx context.Context) {
+	now := time.Now()
+	p.mu.Lock()
+	p.expireDecisions(now)
+	ids := make([]string, 0, len(p.decisions))
+	for id := range p.decisions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return p.decisions[ids[i]].checked.Before(p.decisions[ids[j]].checked)
+	})
+	if len(ids) > reviewBatch {
+		ids = ids[:reviewBatch]
+	}
+	comments := make([]youtube.Comment, len(ids))
+	for i, id := range ids {
+		d := p.decisions[id]
+		d.checked = now
+		p.decisions[id] = d
+		comments[i] = youtube.Comment{ID: id, ParentID: d.parentID}
+	}
+	p.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	statuses, err := p.client.ModerationStatuses(ctx, comments)
+	if err != nil {
+		log.Printf("⚠️  Failed to check reviews of hidden comments: %v", err)
+		return
+	}
+
+	learned := 0
+	p.mu.Lock()
+	for _, id := range ids {
+		d, ok := p.decisions[id]
+		if !ok {
+			continue
+		}
+		status, exists := statuses[id]
+		switch {
+		case !exists:
+			// Deleted, by its author or a moderator: nothing to learn
+			delete(p.decisions, id)
+		case status == "published":
+			log.Printf("🎓 Moderator published [%s] that was %s, learning it as ham: \"%s\"", id, d.action, d.text)
+			p.model.Train(d.text, classifier.Ham)
+			delete(p.decisions, id)
+			learned++
+		case status == "rejected" && d.action == filter.ActionHold:
+			p.model.Train(d.text, classifier.Spam)
+			delete(p.decisions, id)
+			learned++
+		}
+		// Otherwise still held, rejected by us and left so, which may
+		// only mean that no moderator looked at it yet, or a reply whose
+		// review cannot be told
+	}
+	p.mu.Unlock()
+
+	if learned > 0 && p.cfg.ClassifierModel != "" {
+		if err := p.model.Save(p.cfg.ClassifierModel); err != nil {
+			log.Printf("❌ Failed to save classifier model: %v", err)
+		} else {
+			log.Printf("🎓 Learned from %d reviewed comments", learned)
+		}
+	}
+}
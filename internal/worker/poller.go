@@ -2,24 +2,103 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/joshkleinlab/tubeguardian/internal/classifier"
 	"github.com/joshkleinlab/tubeguardian/internal/config"
+	"github.com/joshkleinlab/tubeguardian/internal/dedup"
 	"github.com/joshkleinlab/tubeguardian/internal/filter"
 	"github.com/joshkleinlab/tubeguardian/internal/youtube"
 )
 
 // Poller runs comment fetching & filtering
 type Poller struct {
-	client *youtube.Client
-	f      *filter.Matcher
-	cfg    *config.Config
+	client  YouTube
+	f       atomic.Pointer[filter.Matcher] // swapped when the keyword file changes
+	cfg     *config.Config
+	trusted map[string]bool // channel IDs whose comments are not filtered
+
+	// subscribers caches subscription checks by channel ID. It is only
+	// used by consumeComments.
+	subscribers map[string]subscription
+
+	dups      *dedup.Detector // spam wave detector, nil if disabled
+	dupAction filter.Action   // action for the comments of a wave
+
+	classifier classifier.Classifier // spam probability, nil if disabled
+	model      *classifier.Model     // learns from reviews, nil if not local
+	external   *filter.External      // external classifier, nil if disabled
+
+	// decisions holds the comments we hid, until a moderator reviews
+	// them, see learnFromReviews
+	mu        sync.Mutex
+	decisions map[string]decision
+}
+
+const (
+	// maxLatestThreads bounds the comment threads fetched per poll
+	maxLatestThreads = 1000
+	// subscriberTTL is how long a subscription check is cached
+	subscriberTTL = time.Hour
+	// maxSubscribers bounds the subscription cache
+	maxSubscribers = 10000
+)
+
+// subscription is a cached subscription check
+type subscription struct {
+	subscribed bool
+	checked    time.Time
 }
 
 // NewPoller creates a new poller
-func NewPoller(client *youtube.Client, f *filter.Matcher, cfg *config.Config) *Poller {
-	return &Poller{client: client, f: f, cfg: cfg}
+func NewPoller(client YouTube, f *filter.Matcher, cfg *config.Config) *Poller {
+	p := &Poller{
+		client:      client,
+		cfg:         cfg,
+		trusted:     make(map[string]bool),
+		subscribers: make(map[string]subscription),
+		decisions:   make(map[string]decision),
+	}
+	for _, id := range cfg.TrustedAuthors {
+		p.trusted[id] = true
+	}
+
+	if cfg.DuplicateThreshold > 0 {
+		p.dups = dedup.New(cfg.DuplicateWindow, cfg.DuplicateThreshold, cfg.DuplicateMinLength)
+		p.dupAction = filter.ActionHold
+		for _, a := range []string{cfg.ModeRation, cfg.DuplicateAction} {
+			if a == "" {
+				continue
+			}
+			if action, err := filter.ParseAction(a); err == nil {
+				p.dupAction = action
+			} else {
+				log.Printf("⚠️  Invalid spam wave action %q, using %s", a, p.dupAction)
+			}
+		}
+	}
+
+	p.f.Store(f)
+	return p
+}
+
+// SetClassifier makes the poller moderate comments that c finds likely
+// to be spam, see config.Config.ClassifierHold. A local model also
+// learns from how moderators review the comments the poller hid.
+func (p *Poller) SetClassifier(c classifier.Classifier) {
+	p.classifier = c
+	p.model, _ = c.(*classifier.Model)
+}
+
+// SetExternal makes the poller send every comment to an external
+// classifier, whose action combines with that of the filter
+func (p *Poller) SetExternal(e *filter.External) {
+	p.external = e
 }
 
 // Run starts periodic comment fetching and filtering
@@ -27,23 +106,23 @@ func (p *Poller) Run(ctx context.Context) {
 	log.Println("🚀 TubeGuardian started. Press Ctrl+C to stop.")
 	state := p.client.LoadState()
 
+	// Start comment consumer, before the backfill fills its buffer
+	go p.consumeComments(ctx)
+
 	// If first run → do a full backfill once
 	if state.Mode == "init" {
 		log.Println("📥 First run → Performing full backfill...")
 		if err := p.client.FetchAllComments(ctx); err != nil {
 			log.Printf("❌ Backfill failed: %v", err)
 		}
-		_ = p.client.SaveState(youtube.State{
-			Mode:   "backfillDone",
-			LastID: "", // will be updated as comments stream
-		})
+		p.updateState(func(s *youtube.State) { s.Mode = "backfillDone" })
 	}
 
-	// Start comment consumer
-	go p.consumeComments(ctx)
+	// Reload the keyword list when it changes
+	go p.watchKeywords(ctx)
 
-	// Poll new comments every 5 minutes
-	ticker := time.NewTicker(5 * time.Minute)
+	// Poll new comments every PollInterval
+	ticker := time.NewTicker(p.cfg.PollInterval)
 	defer ticker.Stop()
 
 	for {
@@ -53,35 +132,232 @@ func (p *Poller) Run(ctx context.Context) {
 			return
 		case <-ticker.C:
 			log.Println("🔄 Fetching latest comments...")
-			if err := p.client.FetchLatestComments(ctx, 50); err != nil {
+			if err := p.client.FetchLatestComments(ctx, maxLatestThreads); err != nil {
 				log.Printf("❌ Failed to fetch latest comments: %v", err)
 			}
+			if p.model != nil {
+				p.learnFromReviews(ctx)
+			}
 		}
 	}
 }
 
 // consumeComments
 func (p *Poller) consumeComments(ctx context.Context) {
+	comments := p.client.Comments()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case c := <-p.client.Out:
-			matches := p.f.Match(c.Text)
-			if len(matches) > 0 {
-				log.Printf("🚫 Blocked [%s]: \"%s\" | matches: %v", c.ID, c.Text, matches)
-				if err := p.client.HideComments(ctx, []string{c.ID}, p.cfg.ModeRation); err != nil {
-					log.Printf("❌ Failed to hide comment %s: %v", c.ID, err)
-				} else {
-					log.Printf("✅ Hidden comment %s", c.ID)
-				}
-			}
+		case c := <-comments:
+			p.handle(ctx, c)
 
-			// Save latest ID
-			_ = p.client.SaveState(youtube.State{
-				Mode:   "backfillDone",
-				LastID: c.ID,
+			// Save latest ID. FetchLatestComments stops at the newest
+			// top-level comment seen, so replies are not saved, and
+			// neither are the older comments the backfill sends after
+			// the newest.
+			if c.ParentID != "" {
+				continue
+			}
+			p.updateState(func(s *youtube.State) {
+				if !c.PublishedAt.Before(s.LastPublished) {
+					s.LastID, s.LastPublished = c.ID, c.PublishedAt
+				}
 			})
 		}
 	}
 }
+
+// updateState changes the saved state with update. The mode is left
+// alone unless update sets it, so that a backfill interrupted before it
+// completed runs again on the next start.
+func (p *Poller) updateState(update func(s *youtube.State)) {
+	if err := p.client.UpdateState(update); err != nil {
+		log.Printf("⚠️  Failed to save state: %v", err)
+	}
+}
+
+// handle filters a comment and moderates it. A comment that passes the
+// filter is checked for spam waves, and completing one moderates all
+// the comments of the wave.
+func (p *Poller) handle(ctx context.Context, c youtube.Comment) {
+	if c.AuthorChannelID != "" && p.trusted[c.AuthorChannelID] {
+		log.Printf("👍 Skipped [%s] from trusted author %s", c.ID, c.AuthorChannelID)
+		return
+	}
+
+	if action := p.check(ctx, c); action != "" {
+		if err := p.apply(ctx, []string{c.ID}, action); err == nil && p.model != nil {
+			p.remember(c, action)
+		}
+		return
+	}
+
+	if p.dups != nil {
+		// The window is measured in publication time, so that a backfill
+		// does not take old copies for a wave happening now
+		at := c.PublishedAt
+		if at.IsZero() {
+			at = time.Now()
+		}
+		if wave := p.dups.Add(c.ID, c.PlainText(), at); len(wave) > 0 {
+			log.Printf("🌊 Spam wave: flagging %d near-identical comments %v (latest: \"%s\")", len(wave), wave, c.PlainText())
+			p.apply(ctx, wave, p.dupAction)
+		}
+	}
+}
+
+// check runs the filter over a comment, logs the verdict and returns
+// the action to take, or "" if none
+func (p *Poller) check(ctx context.Context, c youtube.Comment) filter.Action {
+	v := p.f.Load().CheckComment(c.PlainText(), c.Text)
+	action := v.Action
+	if v.LinkAction != "" && !p.isSubscriber(ctx, c.AuthorChannelID) {
+		log.Printf("🔗 Links from non-subscriber [%s]: %v → %s", c.ID, linkHosts(v.Links), v.LinkAction)
+		action = filter.Harsher(action, v.LinkAction)
+	}
+	if len(v.Hits) > 0 {
+		p.report(c, v)
+	}
+	action = filter.Harsher(action, p.classify(ctx, c))
+	return filter.Harsher(action, p.checkExternal(ctx, c))
+}
+
+// checkExternal returns the action the external classifier calls for,
+// or "" if none or it is disabled
+func (p *Poller) checkExternal(ctx context.Context, c youtube.Comment) filter.Action {
+	if p.external == nil {
+		return ""
+	}
+	action, res, err := p.external.Check(ctx, filter.ExternalComment{
+		ID:                c.ID,
+		Text:              c.PlainText(),
+		AuthorChannelID:   c.AuthorChannelID,
+		AuthorDisplayName: c.AuthorDisplayName,
+		VideoID:           c.VideoID,
+		ParentID:          c.ParentID,
+		PublishedAt:       c.PublishedAt,
+	})
+	switch {
+	case err != nil && action != "":
+		log.Printf("⚠️  %v, failing closed for [%s] → %s", err, c.ID, action)
+	case err != nil:
+		log.Printf("⚠️  %v, failing open for [%s]", err, c.ID)
+	case action != "" || len(res.Labels) > 0:
+		log.Printf("🧪 External classifier [%s]: score %g, labels %v → %s: \"%s\"", c.ID, res.Score, res.Labels, action, c.PlainText())
+	}
+	return action
+}
+
+// classify returns the action the classifier's spam probability for a
+// comment calls for, or "" if none
+func (p *Poller) classify(ctx context.Context, c youtube.Comment) filter.Action {
+	if p.classifier == nil {
+		return ""
+	}
+	prob, err := p.classifier.Classify(ctx, c.PlainText())
+	if errors.Is(err, classifier.ErrUntrained) {
+		return ""
+	}
+	if err != nil {
+		log.Printf("⚠️  Failed to classify [%s]: %v", c.ID, err)
+		return ""
+	}
+
+	var action filter.Action
+	switch {
+	case p.cfg.ClassifierReject > 0 && prob >= p.cfg.ClassifierReject:
+		action = filter.ActionReject
+	case p.cfg.ClassifierHold > 0 && prob >= p.cfg.ClassifierHold:
+		action = filter.ActionHold
+	default:
+		return ""
+	}
+	log.Printf("🤖 Classifier [%s]: %.1f%% spam → %s: \"%s\"", c.ID, prob*100, action, c.PlainText())
+	return action
+}
+
+// isSubscriber reports whether a channel subscribes to ours, caching
+// the answer. Authors without a channel are not subscribers. If the
+// check fails, the author is given the benefit of the doubt.
+func (p *Poller) isSubscriber(ctx context.Context, channelID string) bool {
+	if channelID == "" {
+		return false
+	}
+	if s, ok := p.subscribers[channelID]; ok && time.Since(s.checked) < subscriberTTL {
+		return s.subscribed
+	}
+
+	subscribed, err := p.client.IsSubscriber(ctx, channelID)
+	if err != nil {
+		log.Printf("⚠️  Failed to check subscription of %s: %v", channelID, err)
+		return true
+	}
+	if len(p.subscribers) >= maxSubscribers {
+		clear(p.subscribers)
+	}
+	p.subscribers[channelID] = subscription{subscribed: subscribed, checked: time.Now()}
+	return subscribed
+}
+
+// linkHosts lists the hosts of links, for logs
+func linkHosts(links []filter.Link) []string {
+	var hosts []string
+	for _, l := range links {
+		hosts = append(hosts, l.Host)
+	}
+	return hosts
+}
+
+// report logs the verdict on a comment with hits: the rule or score
+// that decided, the heuristic signals it raised, and the score
+// breakdown when scoring is enabled
+func (p *Poller) report(c youtube.Comment, v filter.Verdict) {
+	text := filter.Highlight(c.PlainText(), v.Hits)
+	words := filter.Describe(v.Hits)
+	if len(v.Signals) > 0 {
+		log.Printf("🔎 Signals [%s]: %v", c.ID, v.Signals)
+	}
+	if v.Language != "" {
+		log.Printf("🌐 Language [%s]: %s", c.ID, v.Language)
+	}
+	if v.Score != nil {
+		log.Printf("📊 Score [%s]: %v (hold at %g, reject at %g)", c.ID, v.Score, p.cfg.HoldScore, p.cfg.RejectScore)
+	}
+
+	switch {
+	case v.Rule != nil:
+		log.Printf("🚫 Blocked [%s] by rule %s (%s, %s → %s): \"%s\" | matches: %v",
+			c.ID, v.Rule.Name, v.Rule.Category, v.Rule.Severity, v.Action, text, words)
+	case v.Action != "":
+		log.Printf("🚫 Blocked [%s] by score (→ %s): \"%s\" | matches: %v", c.ID, v.Action, text, words)
+	default:
+		log.Printf("👀 Below thresholds [%s]: \"%s\" | matches: %v", c.ID, text, words)
+	}
+}
+
+// apply moderates comments according to the action that was chosen. It
+// logs the outcome and returns the error, if any.
+func (p *Poller) apply(ctx context.Context, ids []string, action filter.Action) error {
+	var err error
+	switch action {
+	case filter.ActionLog:
+		return nil
+	case filter.ActionHold:
+		err = p.client.SetModerationStatus(ctx, ids, "heldForReview", false)
+	case filter.ActionReject:
+		err = p.client.SetModerationStatus(ctx, ids, "rejected", false)
+	case filter.ActionBan:
+		err = p.client.SetModerationStatus(ctx, ids, "rejected", true)
+	default:
+		log.Printf("⚠️  Unknown action %q for comments %v", action, ids)
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	if err != nil {
+		log.Printf("❌ Failed to hide comments %v: %v", ids, err)
+	} else {
+		log.Printf("✅ Hidden comments %v (%s)", ids, action)
+	}
+	return err
+}
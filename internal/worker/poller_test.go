@@ -0,0 +1,417 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/classifier"
+	"github.com/joshkleinlab/tubeguardian/internal/config"
+	"github.com/joshkleinlab/tubeguardian/internal/filter"
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+	"github.com/joshkleinlab/tubeguardian/internal/youtube/youtubetest"
+)
+
+var _ YouTube = (*youtubetest.Fake)(nil)
+
+var errAPI = errors.New("quotaExceeded")
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestPoller creates a poller over a fake channel, filtering the
+// keywords "cheap followers" and "scam"
+func newTestPoller(t *testing.T, cfg *config.Config) (*Poller, *youtubetest.Fake) {
+	t.Helper()
+	cfg.BannedWordsFile = filepath.Join(t.TempDir(), "banned_words.txt")
+	if err := os.WriteFile(cfg.BannedWordsFile, []byte("cheap followers\nscam\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = 10 * time.Millisecond
+	}
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = 10 * time.Millisecond
+	}
+	m, err := filter.Load(cfg)
+	if err != nil {
+		t.Fatalf("filter.Load: %v", err)
+	}
+	yt := youtubetest.New()
+	return NewPoller(yt, m, cfg), yt
+}
+
+// waitFor waits until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		c    youtube.Comment
+		want []youtubetest.Moderation
+	}{
+		{
+			name: "clean",
+			c:    youtube.Comment{ID: "c1", Text: "Great video!"},
+		},
+		{
+			name: "keyword",
+			c:    youtube.Comment{ID: "c1", Text: "buy cheap followers here"},
+			want: []youtubetest.Moderation{{IDs: []string{"c1"}, Status: "heldForReview"}},
+		},
+		{
+			name: "keyword in HTML",
+			c:    youtube.Comment{ID: "c1", Text: "cheap&nbsp;<b>followers</b>"},
+			want: []youtubetest.Moderation{{IDs: []string{"c1"}, Status: "heldForReview"}},
+		},
+		{
+			name: "reject",
+			cfg:  config.Config{ModeRation: "reject"},
+			c:    youtube.Comment{ID: "c1", Text: "total scam"},
+			want: []youtubetest.Moderation{{IDs: []string{"c1"}, Status: "rejected"}},
+		},
+		{
+			name: "ban",
+			cfg:  config.Config{ModeRation: "ban"},
+			c:    youtube.Comment{ID: "c1", Text: "total scam"},
+			want: []youtubetest.Moderation{{IDs: []string{"c1"}, Status: "rejected", BanAuthor: true}},
+		},
+		{
+			name: "log only",
+			cfg:  config.Config{ModeRation: "log"},
+			c:    youtube.Comment{ID: "c1", Text: "total scam"},
+		},
+		{
+			name: "trusted author",
+			cfg:  config.Config{TrustedAuthors: []string{"UCmod"}},
+			c:    youtube.Comment{ID: "c1", Text: "total scam", AuthorChannelID: "UCmod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, yt := newTestPoller(t, &tt.cfg)
+			yt.Add(tt.c)
+			p.handle(context.Background(), tt.c)
+			if got := yt.Moderations(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("moderations = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinksFromNonSubscribers(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{NonSubscriberLinkAction: "hold"})
+	yt.Subscribe("UCfan")
+	ctx := context.Background()
+
+	comments := []youtube.Comment{
+		{ID: "fan1", Text: "my review: https://example.com/review", AuthorChannelID: "UCfan"},
+		{ID: "fan2", Text: "and part two https://example.com/two", AuthorChannelID: "UCfan"},
+		{ID: "stranger", Text: "visit https://example.com", AuthorChannelID: "UCstranger"},
+		{ID: "nochannel", Text: "visit https://example.com"},
+	}
+	yt.Add(comments...)
+	for _, c := range comments {
+		p.handle(ctx, c)
+	}
+
+	want := []youtubetest.Moderation{
+		{IDs: []string{"stranger"}, Status: "heldForReview"},
+		{IDs: []string{"nochannel"}, Status: "heldForReview"},
+	}
+	if got := yt.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+	// The second comment of UCfan uses the cached check, and authors
+	// without a channel are never looked up
+	if n := yt.Calls(youtubetest.SubscriptionsList); n != 2 {
+		t.Errorf("%d subscription checks, want 2", n)
+	}
+
+	// A failed check gives the benefit of the doubt
+	yt.Fail(youtubetest.SubscriptionsList, errAPI)
+	c := youtube.Comment{ID: "unknown", Text: "visit https://example.com", AuthorChannelID: "UCunknown"}
+	yt.Add(c)
+	p.handle(ctx, c)
+	if got := yt.Status("unknown"); got != "published" {
+		t.Errorf("status after a failed subscription check = %q, want published", got)
+	}
+}
+
+func TestHiddenLinkTargets(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{
+		DeniedDomains:      []string{"evil.com"},
+		DeniedDomainAction: "reject",
+	})
+	ctx := context.Background()
+
+	// The plain text of these is "click here" or "1:00": only the targets
+	// of their links tell them apart
+	comments := []youtube.Comment{
+		{ID: "redirect", Text: `free stuff <a href="https://www.youtube.com/redirect?event=comments&amp;q=https%3A%2F%2Fevil.com%2Fx">click here</a>`},
+		{ID: "direct", Text: `<a href="https://cdn.evil.com/x">my blog</a>`},
+		{ID: "timestamp", Text: `best part <a href="https://www.youtube.com/watch?v=abc&amp;t=60">1:00</a>`},
+	}
+	yt.Add(comments...)
+	for _, c := range comments {
+		p.handle(ctx, c)
+	}
+
+	want := []youtubetest.Moderation{
+		{IDs: []string{"redirect"}, Status: "rejected"},
+		{IDs: []string{"direct"}, Status: "rejected"},
+	}
+	if got := yt.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+}
+
+func TestSpamWave(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{
+		DuplicateThreshold: 3,
+		DuplicateWindow:    time.Minute,
+		DuplicateMinLength: 20,
+	})
+	ctx := context.Background()
+
+	for i, text := range []string{
+		"Check my channel for the best tips!!",
+		"check my channel for the best tips",
+		"Check my chanel for the best tips 🔥",
+	} {
+		c := youtube.Comment{ID: fmt.Sprintf("w%d", i), Text: text}
+		yt.Add(c)
+		p.handle(ctx, c)
+	}
+
+	want := []youtubetest.Moderation{{IDs: []string{"w0", "w1", "w2"}, Status: "heldForReview"}}
+	if got := yt.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+}
+
+func TestSpamWaveBackfill(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{
+		DuplicateThreshold: 3,
+		DuplicateWindow:    10 * time.Minute,
+		DuplicateMinLength: 20,
+	})
+	// Fans post the same greeting every week, bots post theirs minutes
+	// apart; the backfill reads all of them at once
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 4 {
+		yt.Add(youtube.Comment{ID: fmt.Sprintf("fan%d", i), Text: "Happy Friday everyone, see you next week!", PublishedAt: start.Add(time.Duration(i) * 7 * 24 * time.Hour)})
+	}
+	for i := range 3 {
+		yt.Add(youtube.Comment{ID: fmt.Sprintf("bot%d", i), Text: "Check my channel for the best tips!!", PublishedAt: start.Add(30*24*time.Hour + time.Duration(i)*time.Minute)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	waitFor(t, "the backfill", func() bool { return yt.LoadState().Mode == "backfillDone" })
+	waitFor(t, "the wave", func() bool { return len(yt.Moderations()) > 0 })
+	time.Sleep(10 * p.cfg.PollInterval)
+
+	want := []youtubetest.Moderation{{IDs: []string{"bot2", "bot1", "bot0"}, Status: "heldForReview"}}
+	if got := yt.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+}
+
+func TestLearnFromReviews(t *testing.T) {
+	cfg := &config.Config{ClassifierModel: filepath.Join(t.TempDir(), "model.json")}
+	p, yt := newTestPoller(t, cfg)
+	model := classifier.New()
+	p.SetClassifier(model)
+	ctx := context.Background()
+
+	comments := []youtube.Comment{
+		{ID: "published", Text: "is this a scam or not? asking for my grandma"},
+		{ID: "rejected", Text: "cheap followers, DM me on telegram"},
+		{ID: "deleted", Text: "scam scam scam"},
+		{ID: "pending", Text: "cheap followers for sale"},
+		{ID: "rejected reply", ParentID: "pending", Text: "scam, follow me"},
+		{ID: "published reply", ParentID: "pending", Text: "that is a scam, don't"},
+		{ID: "failed", Text: "scam alert"},
+	}
+	yt.Add(comments...)
+	for _, c := range comments[:6] {
+		p.handle(ctx, c)
+	}
+	// A comment the poller failed to hide has no review to learn from
+	yt.Fail(youtubetest.SetModerationStatus, errAPI)
+	p.handle(ctx, comments[6])
+
+	yt.Review("published", "published")
+	yt.Review("rejected", "rejected")
+	yt.Delete("deleted")
+	yt.Review("rejected reply", "rejected")
+	yt.Review("published reply", "published")
+
+	// Reviews that cannot be checked are checked again later
+	yt.Fail(youtubetest.ThreadsList, errAPI)
+	p.learnFromReviews(ctx)
+	if len(p.decisions) != 6 {
+		t.Fatalf("%d decisions after a failed check, want 6", len(p.decisions))
+	}
+
+	// A rejected reply cannot be told from a held one, and stays pending
+	p.learnFromReviews(ctx)
+	if spam, ham := model.Docs(); spam != 1 || ham != 2 {
+		t.Errorf("Docs() = %d, %d; want 1, 2", spam, ham)
+	}
+	_, pending := p.decisions["pending"]
+	_, reply := p.decisions["rejected reply"]
+	if !pending || !reply || len(p.decisions) != 2 {
+		t.Errorf("decisions = %v, want the pending comment and the rejected reply", p.decisions)
+	}
+	if _, err := classifier.Load(cfg.ClassifierModel); err != nil {
+		t.Errorf("model was not saved: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{})
+
+	// More comments than the client buffers, so that the backfill only
+	// completes if they are consumed meanwhile
+	var spam []string
+	for i := range 230 {
+		c := youtube.Comment{ID: fmt.Sprintf("c%03d", i), Text: fmt.Sprintf("comment number %d", i)}
+		if i%50 == 0 {
+			c.Text = "cheap followers"
+			spam = append(spam, c.ID)
+		}
+		yt.Add(c)
+	}
+	yt.Add(youtube.Comment{ID: "r1", ParentID: "c100", Text: "scam, don't click"})
+	spam = append(spam, "r1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+
+	hidden := func(ids ...string) func() bool {
+		return func() bool {
+			for _, id := range ids {
+				if yt.Status(id) != "heldForReview" {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	waitFor(t, "the backfill to hide spam", hidden(spam...))
+	waitFor(t, "the backfill to complete", func() bool { return yt.LoadState().Mode == "backfillDone" })
+	if n := yt.Calls(youtubetest.ThreadsList); n < 3 {
+		t.Errorf("backfill fetched %d pages, want 3", n)
+	}
+
+	// New comments are picked up by the next poll
+	yt.Add(youtube.Comment{ID: "new", Text: "SCAM"})
+	waitFor(t, "a poll to hide a new comment", hidden("new"))
+	if got := yt.Status("c001"); got != "published" {
+		t.Errorf("status of a clean comment = %q, want published", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{})
+
+	// Comments consumed during the backfill do not end it
+	p.updateState(func(s *youtube.State) { s.LastID = "c1" })
+	if got, want := yt.LoadState(), (youtube.State{Mode: "init", LastID: "c1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("state = %+v, want %+v", got, want)
+	}
+	p.updateState(func(s *youtube.State) { s.Mode = "backfillDone" })
+	if got, want := yt.LoadState(), (youtube.State{Mode: "backfillDone", LastID: "c1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("state = %+v, want %+v", got, want)
+	}
+}
+
+func TestLateReplies(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{})
+	now := time.Now().Truncate(time.Second)
+	yt.Add(youtube.Comment{ID: "t1", Text: "nice", PublishedAt: now.Add(-time.Hour)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+	waitFor(t, "the backfill", func() bool { return yt.LoadState().Mode == "backfillDone" })
+
+	// A reply to a thread already processed is still moderated, once
+	yt.Add(youtube.Comment{ID: "t1.r1", ParentID: "t1", Text: "scam", PublishedAt: now})
+	waitFor(t, "a poll to hide the late reply", func() bool { return yt.Status("t1.r1") == "heldForReview" })
+	time.Sleep(10 * p.cfg.PollInterval)
+	want := []youtubetest.Moderation{{IDs: []string{"t1.r1"}, Status: "heldForReview"}}
+	if got := yt.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	p, yt := newTestPoller(t, &config.Config{})
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		yt.Add(youtube.Comment{ID: fmt.Sprintf("old%d", i), Text: "nice", PublishedAt: start.Add(time.Duration(i) * time.Minute)})
+	}
+	yt.Add(youtube.Comment{ID: "reply", ParentID: "old0", Text: "nice", PublishedAt: start.Add(time.Hour)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.Run(ctx)
+
+	// The backfill goes from the newest comment to the oldest, and
+	// replies do not count
+	waitFor(t, "the backfill", func() bool { return yt.LoadState().Mode == "backfillDone" })
+	if got := yt.LoadState().LastID; got != "old4" {
+		t.Errorf("LastID after the backfill = %q, want old4", got)
+	}
+
+	for i := range 3 {
+		yt.Add(youtube.Comment{ID: fmt.Sprintf("new%d", i), Text: "scam", PublishedAt: start.Add(2*time.Hour + time.Duration(i)*time.Minute)})
+	}
+	waitFor(t, "the new comments", func() bool { return yt.LoadState().LastID == "new2" })
+
+	// Let a few more polls run: each new comment is moderated once, oldest
+	// first
+	time.Sleep(10 * p.cfg.PollInterval)
+	want := []youtubetest.Moderation{
+		{IDs: []string{"new0"}, Status: "heldForReview"},
+		{IDs: []string{"new1"}, Status: "heldForReview"},
+		{IDs: []string{"new2"}, Status: "heldForReview"},
+	}
+	if got := yt.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/filter"
+)
+
+// fileVersion identifies a version of a file by its size and mtime
+type fileVersion struct {
+	size    int64
+	modTime int64 // UnixNano
+}
+
+// statVersion returns the current version of the file at path. A missing
+// file has the zero version.
+func statVersion(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+// watchKeywords polls the keyword lists, rules and allowlist files every
+// ReloadInterval and swaps in a new matcher when one of them changes.
+// Comments being filtered meanwhile keep using the matcher they started
+// with. If the new files cannot be loaded, as when one is half written,
+// the error is logged and the previous matcher stays in use; loading is
+// retried every interval until it succeeds.
+func (p *Poller) watchKeywords(ctx context.Context) {
+	var paths []string
+	candidates := []string{p.cfg.BannedWordsFile, p.cfg.RulesFile, p.cfg.AllowlistFile}
+	for _, path := range p.cfg.LanguageKeywordFiles {
+		candidates = append(candidates, path)
+	}
+	for _, path := range candidates {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	versions := func() []fileVersion {
+		v := make([]fileVersion, len(paths))
+		for i, path := range paths {
+			v[i] = statVersion(path)
+		}
+		return v
+	}
+	last := versions()       // of the files loaded
+	var failed []fileVersion // of the files that last failed to load
+
+	ticker := time.NewTicker(p.cfg.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cur := versions()
+			if slices.Equal(cur, last) {
+				continue
+			}
+
+			m, err := filter.Load(p.cfg)
+			if err != nil {
+				// Logged once per version of the files
+				if !slices.Equal(cur, failed) {
+					log.Printf("❌ Failed to reload banned words, keeping the previous list: %v", err)
+				}
+				failed = cur
+				continue
+			}
+			last, failed = cur, nil
+			p.f.Store(m)
+			log.Printf("🔁 Reloaded banned words from %v", paths)
+		}
+	}
+}
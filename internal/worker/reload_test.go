@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/config"
+)
+
+func TestWatchKeywords(t *testing.T) {
+	p, _ := newTestPoller(t, &config.Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.watchKeywords(ctx)
+		close(done)
+	}()
+	defer func() { cancel(); <-done }()
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(p.cfg.BannedWordsFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	matches := func(text string, want ...string) bool {
+		got := p.f.Load().Match(text)
+		return reflect.DeepEqual(got, want) || len(got) == 0 && len(want) == 0
+	}
+
+	// An edited list replaces the matcher, once the watcher has seen the
+	// first one
+	time.Sleep(5 * p.cfg.ReloadInterval)
+	write("cheap followers\nscam\nfree robux\n")
+	waitFor(t, "the edited list", func() bool { return matches("free robux here", "free robux") })
+
+	// A broken list is not loaded, the previous one stays in use
+	before := p.f.Load()
+	write("cheap followers\nscam | bogus\n")
+	time.Sleep(20 * p.cfg.ReloadInterval)
+	if p.f.Load() != before {
+		t.Fatal("matcher replaced by a broken list")
+	}
+	if !matches("free robux here", "free robux") {
+		t.Errorf("previous list no longer matches")
+	}
+
+	// Loading is retried, even if the fixed list has the same size and
+	// mtime as the broken one, as a half written file may
+	info, err := os.Stat(p.cfg.BannedWordsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("cheap followers\nscam\nfreebie\n")
+	if err := os.Chtimes(p.cfg.BannedWordsFile, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the list fixed in place", func() bool { return matches("freebie here", "freebie") })
+
+	// Fixing it is picked up again
+	write("cheap followers\nscam | bogus\n")
+	time.Sleep(5 * p.cfg.ReloadInterval)
+	write("cheap followers\n")
+	waitFor(t, "the fixed list", func() bool { return matches("free robux here") })
+}
@@ -0,0 +1,42 @@
+package worker
+
+import (
+	"context"
+
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+)
+
+// CommentSource fetches the comments of the channel and keeps track of
+// how far it got
+type CommentSource interface {
+	// FetchAllComments sends every comment of the channel to Comments
+	FetchAllComments(ctx context.Context) error
+	// FetchLatestComments sends the comments posted since the last one
+	// saved in the state to Comments, oldest first, up to limit threads,
+	// then the new replies to the recent threads sent before. Threads
+	// left when more are new are sent by later calls.
+	FetchLatestComments(ctx context.Context, limit int64) error
+	// Comments returns the channel fetched comments are sent to
+	Comments() <-chan youtube.Comment
+
+	LoadState() youtube.State
+	// UpdateState changes the saved state with update, one update at a
+	// time
+	UpdateState(update func(s *youtube.State)) error
+}
+
+// Moderator moderates comments and answers what moderation needs to know
+type Moderator interface {
+	SetModerationStatus(ctx context.Context, commentIDs []string, moderationStatus string, banAuthor bool) error
+	ModerationStatuses(ctx context.Context, comments []youtube.Comment) (map[string]string, error)
+	IsSubscriber(ctx context.Context, channelID string) (bool, error)
+}
+
+// YouTube is the channel the poller moderates. *youtube.Client
+// implements it, and youtubetest.Fake stands in for it in tests.
+type YouTube interface {
+	CommentSource
+	Moderator
+}
+
+var _ YouTube = (*youtube.Client)(nil)
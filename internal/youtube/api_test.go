@@ -0,0 +1,559 @@
+package youtube_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/config"
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+	"github.com/joshkleinlab/tubeguardian/internal/youtube/youtubetest"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	api "google.golang.org/api/youtube/v3"
+)
+
+// newTestClient creates a client of a fake API serving f
+func newTestClient(t *testing.T, f *youtubetest.Fake) *youtube.Client {
+	t.Helper()
+	srv := youtubetest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c, err := youtube.NewClient(context.Background(), &config.Config{
+		ChannelID:   "UCours",
+		APIEndpoint: srv.URL,
+		StateFile:   filepath.Join(t.TempDir(), "state.json"),
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+// collect returns the comments fetch sends, and its error
+func collect(c *youtube.Client, fetch func() error) ([]youtube.Comment, error) {
+	errc := make(chan error, 1)
+	go func() { errc <- fetch() }()
+
+	var comments []youtube.Comment
+	for {
+		select {
+		case cm := <-c.Out:
+			comments = append(comments, cm)
+		case err := <-errc:
+			for len(c.Out) > 0 {
+				comments = append(comments, <-c.Out)
+			}
+			return comments, err
+		}
+	}
+}
+
+// ids returns the IDs of comments
+func ids(comments []youtube.Comment) []string {
+	var ids []string
+	for _, c := range comments {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// addThreads adds n top-level comments, t0 to t(n-1), oldest first
+func addThreads(f *youtubetest.Fake, n int) {
+	for i := range n {
+		f.Add(youtube.Comment{ID: fmt.Sprintf("t%d", i), Text: fmt.Sprintf("comment %d", i), VideoID: "vid1"})
+	}
+}
+
+func TestFetchAllComments(t *testing.T) {
+	f := youtubetest.New()
+	addThreads(f, 250)
+	full := youtube.Comment{
+		ID:                "full",
+		Text:              "Tom &amp; Jerry",
+		TextOriginal:      "Tom & Jerry",
+		AuthorChannelID:   "UCauthor",
+		AuthorDisplayName: "@author",
+		VideoID:           "vid2",
+		PublishedAt:       time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC),
+		UpdatedAt:         time.Date(2025, 3, 2, 12, 0, 0, 0, time.UTC),
+		LikeCount:         7,
+		ModerationStatus:  "published",
+	}
+	f.Add(full)
+	for i := range 3 {
+		f.Add(youtube.Comment{ID: fmt.Sprintf("full.r%d", i), ParentID: "full", Text: "reply"})
+	}
+	for i := range 120 {
+		f.Add(youtube.Comment{ID: fmt.Sprintf("t100.r%d", i), ParentID: "t100", Text: "reply"})
+	}
+
+	c := newTestClient(t, f)
+	got, err := collect(c, func() error { return c.FetchAllComments(context.Background()) })
+	if err != nil {
+		t.Fatalf("FetchAllComments: %v", err)
+	}
+
+	if len(got) != 251+3+120 {
+		t.Fatalf("got %d comments, want %d", len(got), 251+3+120)
+	}
+	if want := []string{"full", "full.r0", "full.r1", "full.r2", "t249"}; !reflect.DeepEqual(ids(got[:5]), want) {
+		t.Errorf("first comments = %v, want %v", ids(got[:5]), want)
+	}
+	if !reflect.DeepEqual(got[0], full) {
+		t.Errorf("comment = %+v, want %+v", got[0], full)
+	}
+	if r := got[1]; r.ParentID != "full" {
+		t.Errorf("reply %s has ParentID %q, want full", r.ID, r.ParentID)
+	}
+	// 251 threads in pages of 100, 120 replies fetched in pages of 100
+	if n := f.Calls(youtubetest.ThreadsList); n != 3 {
+		t.Errorf("%d thread pages, want 3", n)
+	}
+	if n := f.Calls(youtubetest.CommentsList); n != 2 {
+		t.Errorf("%d reply pages, want 2", n)
+	}
+}
+
+func TestFetchAllCommentsErrors(t *testing.T) {
+	f := youtubetest.New()
+	addThreads(f, 150)
+	c := newTestClient(t, f)
+
+	// The first page is moderated even if the second fails
+	f.Fail(youtubetest.ThreadsList, nil, youtubetest.ErrBackend)
+	got, err := collect(c, func() error { return c.FetchAllComments(context.Background()) })
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 503 {
+		t.Fatalf("FetchAllComments error = %v, want a 503", err)
+	}
+	if len(got) != 100 {
+		t.Errorf("got %d comments before the error, want 100", len(got))
+	}
+
+	f.Fail(youtubetest.ThreadsList, youtubetest.ErrQuotaExceeded)
+	_, err = collect(c, func() error { return c.FetchAllComments(context.Background()) })
+	if !errors.As(err, &apiErr) || apiErr.Code != 403 || len(apiErr.Errors) == 0 || apiErr.Errors[0].Reason != "quotaExceeded" {
+		t.Errorf("FetchAllComments error = %v, want quotaExceeded", err)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	f := youtubetest.New()
+	addThreads(f, 60)
+	c := newTestClient(t, f)
+	ctx := context.Background()
+
+	if err := c.SetModerationStatus(ctx, []string{"t1", "t2"}, "rejected", true); err != nil {
+		t.Fatalf("SetModerationStatus: %v", err)
+	}
+	want := []youtubetest.Moderation{{IDs: []string{"t1", "t2"}, Status: "rejected", BanAuthor: true}}
+	if got := f.Moderations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("moderations = %+v, want %+v", got, want)
+	}
+
+	f.Fail(youtubetest.SetModerationStatus, errors.New("boom"))
+	var apiErr *googleapi.Error
+	if err := c.HideComment(ctx, "t3"); !errors.As(err, &apiErr) || apiErr.Code != 500 {
+		t.Errorf("HideComment error = %v, want a 500", err)
+	}
+	if got := f.Status("t3"); got != "published" {
+		t.Errorf("status after a failed moderation = %q, want published", got)
+	}
+
+}
+
+func TestModerationStatuses(t *testing.T) {
+	f := youtubetest.New()
+	addThreads(f, 60)
+	f.Add(
+		youtube.Comment{ID: "r1", ParentID: "t10", Text: "reply"},
+		youtube.Comment{ID: "r2", ParentID: "t10", Text: "reply"},
+		youtube.Comment{ID: "r3", ParentID: "t11", Text: "reply"},
+	)
+	c := newTestClient(t, f)
+	ctx := context.Background()
+
+	// We held some comments, and moderators reviewed them
+	if err := c.HideComments(ctx, []string{"t1", "t2", "t3", "t4", "r1", "r2", "r3"}, "heldForReview"); err != nil {
+		t.Fatalf("HideComments: %v", err)
+	}
+	f.Review("t1", "rejected")
+	f.Review("t2", "published")
+	f.Delete("t4")
+	f.Review("r1", "published")
+	f.Review("r3", "rejected")
+
+	comments := []youtube.Comment{{ID: "r1", ParentID: "t10"}, {ID: "r2", ParentID: "t10"}, {ID: "r3", ParentID: "t11"}}
+	for i := range 60 {
+		comments = append(comments, youtube.Comment{ID: fmt.Sprintf("t%d", i)})
+	}
+	statuses, err := c.ModerationStatuses(ctx, comments)
+	if err != nil {
+		t.Fatalf("ModerationStatuses: %v", err)
+	}
+	if len(statuses) != 62 {
+		t.Errorf("%d statuses, want 62", len(statuses))
+	}
+	for id, want := range map[string]string{
+		"t0": "published", "t1": "rejected", "t2": "published", "t3": "heldForReview",
+		"r1": "published", "r2": "", "r3": "",
+	} {
+		if got, ok := statuses[id]; !ok || got != want {
+			t.Errorf("status of %s = %q, want %q", id, got, want)
+		}
+	}
+	if _, ok := statuses["t4"]; ok {
+		t.Errorf("deleted comment has status %q", statuses["t4"])
+	}
+	// Two thread lookups, the held threads, the replies of two threads and
+	// one lookup of the others
+	if n, m := f.Calls(youtubetest.ThreadsList), f.Calls(youtubetest.CommentsList); n != 3 || m != 3 {
+		t.Errorf("%d commentThreads.list and %d comments.list calls, want 3 and 3", n, m)
+	}
+
+	// With too many held threads to list, a comment missing from the
+	// first pages may still be held
+	for i := range 600 {
+		f.Add(youtube.Comment{ID: fmt.Sprintf("h%d", i), Text: "held", ModerationStatus: "heldForReview"})
+	}
+	statuses, err = c.ModerationStatuses(ctx, []youtube.Comment{{ID: "t1"}, {ID: "t3"}})
+	if err != nil {
+		t.Fatalf("ModerationStatuses: %v", err)
+	}
+	if got := statuses["t1"]; got != "" {
+		t.Errorf("status of t1 with held threads left unlisted = %q, want \"\"", got)
+	}
+
+	f.Fail(youtubetest.ThreadsList, youtubetest.ErrBackend)
+	if _, err := c.ModerationStatuses(ctx, comments); err == nil {
+		t.Errorf("ModerationStatuses: expected error")
+	}
+}
+
+func TestListings(t *testing.T) {
+	f := youtubetest.New()
+	addThreads(f, 5)
+	f.Add(
+		youtube.Comment{ID: "r1", ParentID: "t0", Text: "reply"},
+		youtube.Comment{ID: "r2", ParentID: "t0", Text: "reply", ModerationStatus: "heldForReview"},
+	)
+	f.Review("t1", "heldForReview")
+	f.Review("t2", "rejected")
+	srv := youtubetest.NewServer(f)
+	defer srv.Close()
+	ctx := context.Background()
+
+	// Fetching lists only published comments, over HTTP and from the fake
+	c := newTestClient(t, f)
+	comments, err := collect(c, func() error { return c.FetchAllComments(ctx) })
+	if err != nil {
+		t.Fatalf("FetchAllComments: %v", err)
+	}
+	want := []string{"t4", "t3", "t0", "r1"}
+	if got := ids(comments); !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchAllComments = %v, want %v", got, want)
+	}
+	if err := f.FetchAllComments(ctx); err != nil {
+		t.Fatalf("Fake.FetchAllComments: %v", err)
+	}
+	var fromFake []string
+	for len(f.Comments()) > 0 {
+		fromFake = append(fromFake, (<-f.Comments()).ID)
+	}
+	if !reflect.DeepEqual(fromFake, want) {
+		t.Errorf("Fake.FetchAllComments = %v, want %v", fromFake, want)
+	}
+
+	service, err := api.NewService(ctx, option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups by ID find comments whatever their status, but do not say it
+	byID, err := service.Comments.List([]string{"snippet"}).Id("t0", "t1", "t2").Do()
+	if err != nil {
+		t.Fatalf("comments.list: %v", err)
+	}
+	if len(byID.Items) != 3 {
+		t.Errorf("comments.list by ID = %d comments, want 3", len(byID.Items))
+	}
+	for _, item := range byID.Items {
+		if item.Snippet.ModerationStatus != "" {
+			t.Errorf("comments.list by ID: %s has moderationStatus %q", item.Id, item.Snippet.ModerationStatus)
+		}
+	}
+
+	// Other statuses are listed when asked for
+	held, err := service.CommentThreads.List([]string{"snippet"}).
+		AllThreadsRelatedToChannelId("UCours").
+		ModerationStatus("heldForReview").Do()
+	if err != nil {
+		t.Fatalf("commentThreads.list: %v", err)
+	}
+	if len(held.Items) != 1 || held.Items[0].Id != "t1" || held.Items[0].Snippet.TopLevelComment.Snippet.ModerationStatus != "heldForReview" {
+		t.Errorf("held threads = %+v", held.Items)
+	}
+}
+
+func TestIsSubscriber(t *testing.T) {
+	f := youtubetest.New()
+	f.Subscribe("UCfan")
+	c := newTestClient(t, f)
+	ctx := context.Background()
+
+	for channel, want := range map[string]bool{"UCfan": true, "UCstranger": false} {
+		if got, err := c.IsSubscriber(ctx, channel); err != nil || got != want {
+			t.Errorf("IsSubscriber(%s) = %v, %v; want %v", channel, got, err, want)
+		}
+	}
+	f.Fail(youtubetest.SubscriptionsList, youtubetest.ErrBackend)
+	if _, err := c.IsSubscriber(ctx, "UCfan"); err == nil {
+		t.Errorf("IsSubscriber: expected error")
+	}
+}
+
+func TestState(t *testing.T) {
+	c := newTestClient(t, youtubetest.New())
+	if got := c.LoadState(); got.Mode != "init" {
+		t.Errorf("initial state = %+v, want init", got)
+	}
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	want := youtube.State{Mode: "backfillDone", LastID: "t1", Threads: map[string]youtube.ThreadState{
+		"t1": {Published: now, Replies: 2, LastReply: now.Add(time.Minute)},
+	}}
+	if err := c.SaveState(want); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	if got := c.LoadState(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadState = %+v, want %+v", got, want)
+	}
+
+	// Watching a thread forgets those too old, then the oldest beyond 500
+	err := c.UpdateState(func(s *youtube.State) {
+		for i := range 501 {
+			s.Watch(fmt.Sprintf("n%d", i), youtube.ThreadState{Published: now.Add(time.Duration(i) * time.Minute)}, now.Add(7*24*time.Hour))
+		}
+	})
+	if err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	got := c.LoadState().Threads
+	if _, ok := got["t1"]; ok || len(got) != 500 {
+		t.Errorf("watched %d threads, t1 among them: %v; want 500 without t1", len(got), ok)
+	}
+	if _, ok := got["n0"]; ok {
+		t.Errorf("watched the oldest thread beyond 500")
+	}
+}
+
+func TestNewReplies(t *testing.T) {
+	f := youtubetest.New()
+	now := time.Now().Truncate(time.Second)
+	f.Add(
+		youtube.Comment{ID: "old", Text: "comment", PublishedAt: now.Add(-30 * 24 * time.Hour)},
+		youtube.Comment{ID: "t1", Text: "comment", PublishedAt: now.Add(-2 * time.Hour)},
+		youtube.Comment{ID: "t1.r1", ParentID: "t1", Text: "reply", PublishedAt: now.Add(-time.Hour)},
+		youtube.Comment{ID: "t2", Text: "comment", PublishedAt: now.Add(-time.Hour)},
+	)
+	c := newTestClient(t, f)
+	ctx := context.Background()
+
+	// The backfill watches the recent threads
+	if _, err := collect(c, func() error { return c.FetchAllComments(ctx) }); err != nil {
+		t.Fatalf("FetchAllComments: %v", err)
+	}
+	watched := c.LoadState().Threads
+	if _, ok := watched["old"]; ok || len(watched) != 2 {
+		t.Errorf("watched threads = %v, want t1 and t2", watched)
+	}
+	if err := c.UpdateState(func(s *youtube.State) { s.LastID, s.LastPublished = "t2", now.Add(-time.Hour) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// poll fetches the latest comments and checks the API calls it made
+	poll := func(want []string, threads, comments int) {
+		t.Helper()
+		t0, c0 := f.Calls(youtubetest.ThreadsList), f.Calls(youtubetest.CommentsList)
+		got, err := collect(c, func() error { return c.FetchLatestComments(ctx, 1000) })
+		if err != nil {
+			t.Fatalf("FetchLatestComments: %v", err)
+		}
+		if !reflect.DeepEqual(ids(got), want) {
+			t.Errorf("sent %v, want %v", ids(got), want)
+		}
+		if n := f.Calls(youtubetest.ThreadsList) - t0; n != threads {
+			t.Errorf("%d commentThreads.list calls, want %d", n, threads)
+		}
+		if n := f.Calls(youtubetest.CommentsList) - c0; n != comments {
+			t.Errorf("%d comments.list calls, want %d", n, comments)
+		}
+	}
+
+	// Replies posted since are sent once, only those of recent threads,
+	// and threads whose reply count did not change are not listed
+	f.Add(
+		youtube.Comment{ID: "t1.r2", ParentID: "t1", Text: "reply", PublishedAt: now.Add(-time.Minute)},
+		youtube.Comment{ID: "old.r1", ParentID: "old", Text: "reply", PublishedAt: now},
+	)
+	poll([]string{"t1.r2"}, 2, 1)
+	poll(nil, 2, 0)
+
+	// A reply taken down does not bring back those sent before
+	f.Review("t1.r2", "heldForReview")
+	poll(nil, 2, 1)
+
+	// New threads are read whole, and watched from then on
+	f.Add(
+		youtube.Comment{ID: "t3", Text: "comment", PublishedAt: now},
+		youtube.Comment{ID: "t3.r1", ParentID: "t3", Text: "reply", PublishedAt: now},
+	)
+	if err := c.UpdateState(func(s *youtube.State) { s.LastID = "t2" }); err != nil {
+		t.Fatal(err)
+	}
+	poll([]string{"t3", "t3.r1"}, 2, 0)
+	if _, ok := c.LoadState().Threads["t3"]; !ok {
+		t.Errorf("t3 not watched")
+	}
+
+	// Threads that are gone are not watched anymore
+	f.Delete("t2")
+	if err := c.UpdateState(func(s *youtube.State) { s.LastID = "t3" }); err != nil {
+		t.Fatal(err)
+	}
+	poll(nil, 2, 0)
+	if _, ok := c.LoadState().Threads["t2"]; ok {
+		t.Errorf("deleted t2 still watched")
+	}
+}
+
+func TestFetchLatestComments(t *testing.T) {
+	f := youtubetest.New()
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	published := func(i int) time.Time { return start.Add(time.Duration(i) * time.Minute) }
+	for i := range 250 {
+		f.Add(youtube.Comment{ID: fmt.Sprintf("t%d", i), Text: "comment", PublishedAt: published(i)})
+	}
+	f.Add(youtube.Comment{ID: "t200.r0", ParentID: "t200", Text: "reply", PublishedAt: published(251)})
+	c := newTestClient(t, f)
+	ctx := context.Background()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name  string
+		state youtube.State
+		limit int64
+		first string // oldest comment sent
+		n     int    // comments sent
+		pages int
+		warn  bool
+		gaps  []youtube.Gap // left for the next polls
+	}{
+		{"by ID", youtube.State{LastID: "t99", LastPublished: published(99)}, 1000, "t100", 151, 2, false, nil},
+		{"deleted watermark", youtube.State{LastID: "gone", LastPublished: published(199).Add(time.Second)}, 1000, "t200", 51, 1, false, nil},
+		{"old state without time", youtube.State{LastID: "t239"}, 1000, "t240", 10, 1, false, nil},
+		{"capped", youtube.State{LastID: "t9", LastPublished: published(9)}, 150, "t100", 151, 2, true,
+			[]youtube.Gap{{FromID: "t100", FromPublished: published(100), ToID: "t9", ToPublished: published(9)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			pages := f.Calls(youtubetest.ThreadsList)
+			if err := c.SaveState(tt.state); err != nil {
+				t.Fatal(err)
+			}
+			got, err := collect(c, func() error { return c.FetchLatestComments(ctx, tt.limit) })
+			if err != nil {
+				t.Fatalf("FetchLatestComments: %v", err)
+			}
+
+			if len(got) != tt.n || got[0].ID != tt.first || got[len(got)-1].ID != "t249" {
+				t.Errorf("got %d comments from %s to %s, want %d from %s to t249",
+					len(got), got[0].ID, got[len(got)-1].ID, tt.n, tt.first)
+			}
+			var last youtube.Comment // previous top-level comment
+			for _, cm := range got {
+				if cm.ParentID != "" {
+					continue
+				}
+				if cm.PublishedAt.Before(last.PublishedAt) {
+					t.Errorf("%s sent after the newer %s", cm.ID, last.ID)
+					break
+				}
+				last = cm
+			}
+			if n := f.Calls(youtubetest.ThreadsList) - pages; n != tt.pages {
+				t.Errorf("fetched %d pages, want %d", n, tt.pages)
+			}
+			if warned := strings.Contains(logs.String(), "left for the next polls"); warned != tt.warn {
+				t.Errorf("warning logged = %v, want %v: %s", warned, tt.warn, logs.String())
+			}
+			if gaps := c.LoadState().Gaps; !reflect.DeepEqual(gaps, tt.gaps) {
+				t.Errorf("gaps = %+v, want %+v", gaps, tt.gaps)
+			}
+		})
+	}
+
+	// Nothing is sent when a page fails, so the next poll starts over
+	if err := c.SaveState(youtube.State{LastID: "t9", LastPublished: published(9)}); err != nil {
+		t.Fatal(err)
+	}
+	f.Fail(youtubetest.ThreadsList, nil, youtubetest.ErrQuotaExceeded)
+	got, err := collect(c, func() error { return c.FetchLatestComments(ctx, 1000) })
+	if err == nil || len(got) > 0 {
+		t.Errorf("FetchLatestComments with a failing page = %d comments, %v; want none and an error", len(got), err)
+	}
+
+	// The threads a capped poll skipped are fetched by the next polls,
+	// after the new ones, each once
+	seen := make(map[string]int)
+	poll := func(limit int64) {
+		t.Helper()
+		got, err := collect(c, func() error { return c.FetchLatestComments(ctx, limit) })
+		if err != nil {
+			t.Fatalf("FetchLatestComments: %v", err)
+		}
+		for _, cm := range got {
+			seen[cm.ID]++
+		}
+		// Move the watermark as the poller does
+		if err := c.UpdateState(func(s *youtube.State) {
+			for _, cm := range got {
+				if cm.ParentID == "" && !cm.PublishedAt.Before(s.LastPublished) {
+					s.LastID, s.LastPublished = cm.ID, cm.PublishedAt
+				}
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll(150) // t100 to t249
+	f.Add(youtube.Comment{ID: "t250", Text: "comment", PublishedAt: published(250)})
+	poll(50) // t250, then t99 to t51
+	want := []youtube.Gap{{FromID: "t51", FromPublished: published(51), ToID: "t9", ToPublished: published(9)}}
+	if gaps := c.LoadState().Gaps; !reflect.DeepEqual(gaps, want) {
+		t.Errorf("gaps after two polls = %+v, want %+v", gaps, want)
+	}
+	poll(1000) // t50 to t10
+	if gaps := c.LoadState().Gaps; gaps != nil {
+		t.Errorf("gaps after catching up = %+v, want none", gaps)
+	}
+	for i := 10; i <= 250; i++ {
+		if id := fmt.Sprintf("t%d", i); seen[id] != 1 {
+			t.Errorf("%s fetched %d times, want once", id, seen[id])
+		}
+	}
+	if len(seen) != 242 {
+		t.Errorf("fetched %d comments, want 242", len(seen))
+	}
+}
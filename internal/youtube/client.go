@@ -2,8 +2,19 @@ package youtube
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/joshkleinlab/tubeguardian/internal/config"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 	youtube "google.golang.org/api/youtube/v3"
 )
 
@@ -11,32 +22,82 @@ import (
 type Client struct {
 	channelID string
 	service   *youtube.Service
+	statePath string
+	stateMu   sync.Mutex   // serializes UpdateState
 	Out       chan Comment // 🔑 Channel for streaming comments
 }
 
 // Comment represents a YouTube comment
 type Comment struct {
-	ID   string
-	Text string
+	ID                string
+	Text              string // as displayed, in HTML
+	TextOriginal      string // as written, "" if the API does not return it
+	AuthorChannelID   string
+	AuthorDisplayName string
+	VideoID           string // "" for comments on the channel itself
+	ParentID          string // ID of the thread's top-level comment for replies, "" otherwise
+	PublishedAt       time.Time
+	UpdatedAt         time.Time
+	LikeCount         int64
+	ModerationStatus  string // "published", "heldForReview", "likelySpam" or "rejected"
 }
 
-// NewClient initializes YouTube client with OAuth2
-func NewClient(ctx context.Context, channelID, credentialsFile string) (*Client, error) {
-	service, err := NewYouTubeService(ctx, credentialsFile)
+// PlainText returns the text of the comment without markup: the
+// original text if the API returned it (it only has to for the author),
+// otherwise the displayed text with its HTML removed
+func (c Comment) PlainText() string {
+	if c.TextOriginal != "" {
+		return c.TextOriginal
+	}
+	return plainText(c.Text)
+}
+
+var (
+	// lineBreak matches the <br> tags of TextDisplay
+	lineBreak = regexp.MustCompile(`(?i)<br\s*/?>`)
+	// htmlTag matches any other tag
+	htmlTag = regexp.MustCompile(`<[^<>]*>`)
+)
+
+// plainText converts the HTML of TextDisplay to plain text
+func plainText(s string) string {
+	s = lineBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// NewClient initializes YouTube client with OAuth2, or without
+// authentication when cfg.APIEndpoint points it at a fake API
+func NewClient(ctx context.Context, cfg *config.Config) (*Client, error) {
+	var service *youtube.Service
+	var err error
+	if cfg.APIEndpoint != "" {
+		service, err = youtube.NewService(ctx, option.WithEndpoint(cfg.APIEndpoint), option.WithoutAuthentication())
+	} else {
+		service, err = NewYouTubeService(ctx, cfg.CredentialsFile)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	return &Client{
-		channelID: channelID,
+		channelID: cfg.ChannelID,
 		service:   service,
+		statePath: cfg.StateFile,
 		Out:       make(chan Comment, 150), // buffered
 	}, nil
 }
 
-// FetchAllComments performs a global scan (first run) with paging
+// Comments returns the channel the fetched comments are sent to
+func (c *Client) Comments() <-chan Comment {
+	return c.Out
+}
+
+// FetchAllComments performs a global scan (first run) with paging.
+// Every thread's replies follow its top-level comment. Recent threads
+// are watched for new replies, see State.Threads.
 func (c *Client) FetchAllComments(ctx context.Context) error {
-	call := c.service.CommentThreads.List([]string{"snippet"}).
+	call := c.service.CommentThreads.List([]string{"snippet", "replies"}).
 		AllThreadsRelatedToChannelId(c.channelID).
 		Order("time").
 		MaxResults(100)
@@ -47,13 +108,19 @@ func (c *Client) FetchAllComments(ctx context.Context) error {
 			return fmt.Errorf("API error (FetchAllComments): %w", err)
 		}
 
+		read := make(map[string]ThreadState)
 		for _, item := range resp.Items {
-			cmt := item.Snippet.TopLevelComment.Snippet
-			c.Out <- Comment{
-				ID:   item.Snippet.TopLevelComment.Id,
-				Text: cmt.TextDisplay,
+			replies, err := c.replies(ctx, item)
+			if err != nil {
+				return err
+			}
+			c.Out <- newComment(item.Snippet.TopLevelComment)
+			for _, r := range replies {
+				c.Out <- r
 			}
+			read[item.Id] = threadState(item, replies)
 		}
+		c.watch(read)
 
 		if resp.NextPageToken == "" {
 			break
@@ -64,35 +131,270 @@ func (c *Client) FetchAllComments(ctx context.Context) error {
 	return nil
 }
 
-// FetchLatestComments gets only new comments since last run
-func (c *Client) FetchLatestComments(ctx context.Context, maxResults int64) error {
-	state := c.LoadState()
+// FetchLatestComments gets only new comments since last run, with the
+// replies of their threads. It pages back from the newest thread until
+// the last one saved in the state (by ID, or by publish time if it was
+// deleted), and sends the new threads oldest first, so that the state
+// can follow them. At most limit threads are fetched: if more are new,
+// the older ones are left for the next polls with a warning, as a gap
+// in the state that they fill once the new threads are fetched, see
+// Scan. The new replies of the threads watched since earlier polls
+// follow, see fetchNewReplies.
+func (c *Client) FetchLatestComments(ctx context.Context, limit int64) error {
+	scan := c.LoadState().NewScan(int(limit))
 
-	call := c.service.CommentThreads.List([]string{"snippet"}).
+	call := c.service.CommentThreads.List([]string{"snippet", "replies"}).
 		ChannelId(c.channelID).
 		Order("time").
-		MaxResults(maxResults)
+		MaxResults(100)
 
-	resp, err := call.Context(ctx).Do()
+	var threads []*youtube.CommentThread
+	for done := false; !done; {
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("API error (FetchLatestComments): %w", err)
+		}
+
+		for _, item := range resp.Items {
+			top := item.Snippet.TopLevelComment
+			var take bool
+			take, done = scan.Next(top.Id, parseTime(top.Snippet.PublishedAt))
+			if take {
+				threads = append(threads, item)
+			}
+			if done {
+				break
+			}
+		}
+
+		if !done && resp.NextPageToken == "" {
+			scan.End()
+			done = true
+		}
+		call = call.PageToken(resp.NextPageToken)
+	}
+	if scan.Capped() {
+		log.Printf("⚠️  More than %d comment threads to check, older ones are left for the next polls", limit)
+	}
+	if err := c.UpdateState(func(s *State) { s.Gaps = scan.Gaps() }); err != nil {
+		log.Printf("⚠️  Failed to save the threads left for the next polls: %v", err)
+	}
+
+	read := make(map[string]ThreadState)
+	for i := len(threads) - 1; i >= 0; i-- {
+		replies, err := c.replies(ctx, threads[i])
+		if err != nil {
+			return err
+		}
+		c.Out <- newComment(threads[i].Snippet.TopLevelComment)
+		for _, r := range replies {
+			c.Out <- r
+		}
+		read[threads[i].Id] = threadState(threads[i], replies)
+	}
+	c.watch(read)
+
+	return c.fetchNewReplies(ctx, read)
+}
+
+// fetchNewReplies sends the replies posted to the watched threads, other
+// than those just read, since they were last read. Threads are looked
+// up 50 at a time, and only those whose reply count changed have their
+// replies listed, to send the ones newer than the newest read before.
+// Threads that are gone, or no longer published, are not watched
+// anymore.
+func (c *Client) fetchNewReplies(ctx context.Context, read map[string]ThreadState) error {
+	watched := c.LoadState().Threads
+	var ids []string
+	for id := range watched {
+		if _, ok := read[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	for batch := range slices.Chunk(ids, lookupBatch) {
+		resp, err := c.service.CommentThreads.List([]string{"snippet"}).
+			Id(batch...).
+			Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("API error (new replies): %w", err)
+		}
+
+		found := make(map[string]ThreadState)
+		for _, item := range resp.Items {
+			t := watched[item.Id]
+			if item.Snippet.TotalReplyCount != t.Replies {
+				replies, err := c.listReplies(ctx, item.Id)
+				if err != nil {
+					return err
+				}
+				for _, r := range replies {
+					if r.PublishedAt.After(t.LastReply) {
+						c.Out <- r
+					}
+				}
+				last := t.LastReply
+				t = threadState(item, replies)
+				t.LastReply = later(t.LastReply, last)
+			}
+			found[item.Id] = t
+		}
+
+		now := time.Now()
+		err = c.UpdateState(func(s *State) {
+			for _, id := range batch {
+				if t, ok := found[id]; ok {
+					s.Watch(id, t, now)
+				} else {
+					delete(s.Threads, id)
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("⚠️  Failed to save watched threads: %v", err)
+		}
+	}
+	return nil
+}
+
+// watch records the threads just read that are recent enough to be
+// watched for new replies
+func (c *Client) watch(read map[string]ThreadState) {
+	now := time.Now()
+	recent := make(map[string]ThreadState)
+	for id, t := range read {
+		if t.watchable(now) {
+			recent[id] = t
+		}
+	}
+	if len(recent) == 0 {
+		return
+	}
+	err := c.UpdateState(func(s *State) {
+		for id, t := range recent {
+			s.Watch(id, t, now)
+		}
+	})
 	if err != nil {
-		return fmt.Errorf("API error (FetchLatestComments): %w", err)
+		log.Printf("⚠️  Failed to save watched threads: %v", err)
 	}
+}
 
-	for _, item := range resp.Items {
-		cmt := item.Snippet.TopLevelComment.Snippet
-		comment := Comment{
-			ID:   item.Snippet.TopLevelComment.Id,
-			Text: cmt.TextDisplay,
+// threadState returns how far a thread was read, given the replies read
+func threadState(thread *youtube.CommentThread, replies []Comment) ThreadState {
+	t := ThreadState{
+		Published: parseTime(thread.Snippet.TopLevelComment.Snippet.PublishedAt),
+		Replies:   thread.Snippet.TotalReplyCount,
+	}
+	for _, r := range replies {
+		if r.PublishedAt.After(t.LastReply) {
+			t.LastReply = r.PublishedAt
 		}
+	}
+	return t
+}
 
-		if comment.ID == state.LastID {
-			break
+// later returns the later of two times
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// replies returns the replies of a comment thread. Threads list only a
+// few of their replies inline; when a thread has more, all of them are
+// fetched by parent ID.
+func (c *Client) replies(ctx context.Context, thread *youtube.CommentThread) ([]Comment, error) {
+	var inline []*youtube.Comment
+	if thread.Replies != nil {
+		inline = thread.Replies.Comments
+	}
+	if thread.Snippet.TotalReplyCount > int64(len(inline)) {
+		return c.listReplies(ctx, thread.Snippet.TopLevelComment.Id)
+	}
+	replies := make([]Comment, len(inline))
+	for i, r := range inline {
+		replies[i] = newComment(r)
+	}
+	return replies, nil
+}
+
+// listReplies returns all the replies to a top-level comment
+func (c *Client) listReplies(ctx context.Context, parentID string) ([]Comment, error) {
+	var replies []Comment
+	call := c.service.Comments.List([]string{"snippet"}).
+		ParentId(parentID).
+		MaxResults(100)
+	for {
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("API error (replies of %s): %w", parentID, err)
+		}
+		for _, r := range resp.Items {
+			replies = append(replies, newComment(r))
 		}
+		if resp.NextPageToken == "" {
+			return replies, nil
+		}
+		call = call.PageToken(resp.NextPageToken)
+	}
+}
 
-		c.Out <- comment
+// newComment converts a comment from the API. Replies carry the ID of
+// their thread's top-level comment in ParentID.
+func newComment(cmt *youtube.Comment) Comment {
+	s := cmt.Snippet
+	return Comment{
+		ID:                cmt.Id,
+		Text:              s.TextDisplay,
+		TextOriginal:      s.TextOriginal,
+		AuthorChannelID:   authorChannelID(s),
+		AuthorDisplayName: s.AuthorDisplayName,
+		VideoID:           s.VideoId,
+		ParentID:          s.ParentId,
+		PublishedAt:       parseTime(s.PublishedAt),
+		UpdatedAt:         parseTime(s.UpdatedAt),
+		LikeCount:         s.LikeCount,
+		ModerationStatus:  s.ModerationStatus,
 	}
+}
 
-	return nil
+// parseTime parses an API timestamp, giving the zero time if it is
+// missing or malformed
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// authorChannelID returns the channel ID of a comment's author, or ""
+// if the author has no channel
+func authorChannelID(s *youtube.CommentSnippet) string {
+	if s.AuthorChannelId == nil {
+		return ""
+	}
+	return s.AuthorChannelId.Value
+}
+
+// IsSubscriber reports whether the channel with the given ID subscribes
+// to our channel. Only public subscriptions can be seen, so a channel
+// that keeps its subscriptions private counts as not subscribed.
+func (c *Client) IsSubscriber(ctx context.Context, channelID string) (bool, error) {
+	call := c.service.Subscriptions.List([]string{"id"}).
+		ChannelId(channelID).
+		ForChannelId(c.channelID).
+		MaxResults(1)
+
+	resp, err := call.Context(ctx).Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+			return false, nil
+		}
+		return false, fmt.Errorf("API error (IsSubscriber): %w", err)
+	}
+	return len(resp.Items) > 0, nil
 }
 
 // HideComment hides a single comment
@@ -102,11 +404,21 @@ func (c *Client) HideComment(ctx context.Context, commentID string) error {
 
 // HideComments hides multiple comments at once
 func (c *Client) HideComments(ctx context.Context, commentIDs []string, moderationStatus string) error {
+	return c.SetModerationStatus(ctx, commentIDs, moderationStatus, false)
+}
+
+// SetModerationStatus sets the moderation status of comments. With
+// banAuthor, the authors of rejected comments are also banned from the
+// channel.
+func (c *Client) SetModerationStatus(ctx context.Context, commentIDs []string, moderationStatus string, banAuthor bool) error {
 	if len(commentIDs) == 0 {
 		return nil
 	}
 
 	call := c.service.Comments.SetModerationStatus(commentIDs, moderationStatus)
+	if banAuthor {
+		call = call.BanAuthor(true)
+	}
 	err := call.Context(ctx).Do()
 	if err != nil {
 		return fmt.Errorf("failed to hide comments %v: %w", commentIDs, err)
@@ -0,0 +1,21 @@
+package youtube
+
+import "testing"
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		c    Comment
+		want string
+	}{
+		{Comment{Text: "Tom &amp; Jerry &quot;rocks&quot;<br>line two"}, "Tom & Jerry \"rocks\"\nline two"},
+		{Comment{Text: `visit <a href="https://www.youtube.com/redirect?q=https%3A%2F%2Fexample.com">https://example.com</a> now`},
+			"visit https://example.com now"},
+		{Comment{Text: "<b>bold</b> &lt;3"}, "bold <3"},
+		{Comment{Text: "displayed &amp; escaped", TextOriginal: "as <written> & typed"}, "as <written> & typed"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.PlainText(); got != tt.want {
+			t.Errorf("PlainText(%+v) = %q, want %q", tt.c, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package youtube
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+const (
+	// lookupBatch is how many comments or threads a list call can look
+	// up by ID
+	lookupBatch = 50
+	// maxHeldPages bounds the pages of held threads listed per check
+	maxHeldPages = 5
+)
+
+// ModerationStatuses tells how moderators reviewed comments we
+// moderated. The API does not return the moderation status of comments
+// looked up by ID, and lists only published comments unless asked for
+// another status, so the status is worked out from which listings a
+// comment is in:
+//
+//   - "published" if its thread, or the replies of its thread, list it;
+//   - "heldForReview" if the held threads of the channel list it;
+//   - "rejected" if it still exists but is in neither listing;
+//   - "" if it cannot be told: a reply that is not published (replies
+//     cannot be listed by status), or a top-level comment when there are
+//     too many held threads to list them all.
+//
+// Comments that no longer exist are left out. Only ID and ParentID of
+// the comments are used.
+func (c *Client) ModerationStatuses(ctx context.Context, comments []Comment) (map[string]string, error) {
+	statuses := make(map[string]string)
+	var top []string
+	var parents []string
+	for _, cmt := range comments {
+		if cmt.ParentID == "" {
+			top = append(top, cmt.ID)
+		} else if !slices.Contains(parents, cmt.ParentID) {
+			parents = append(parents, cmt.ParentID)
+		}
+	}
+
+	// Published top-level comments, by the ID of their thread (which is
+	// that of its top-level comment)
+	for ids := range slices.Chunk(top, lookupBatch) {
+		resp, err := c.service.CommentThreads.List([]string{"id"}).
+			Id(ids...).
+			Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("API error (ModerationStatuses): %w", err)
+		}
+		for _, item := range resp.Items {
+			statuses[item.Id] = "published"
+		}
+	}
+
+	// Published replies
+	for _, parent := range parents {
+		call := c.service.Comments.List([]string{"id"}).
+			ParentId(parent).
+			MaxResults(100)
+		for {
+			resp, err := call.Context(ctx).Do()
+			if err != nil {
+				return nil, fmt.Errorf("API error (replies of %s): %w", parent, err)
+			}
+			for _, item := range resp.Items {
+				statuses[item.Id] = "published"
+			}
+			if resp.NextPageToken == "" {
+				break
+			}
+			call = call.PageToken(resp.NextPageToken)
+		}
+	}
+
+	var rest []string
+	reply := make(map[string]bool)
+	anyTop := false
+	for _, cmt := range comments {
+		if statuses[cmt.ID] == "" {
+			rest = append(rest, cmt.ID)
+			reply[cmt.ID] = cmt.ParentID != ""
+			anyTop = anyTop || cmt.ParentID == ""
+		}
+	}
+	if len(rest) == 0 {
+		return keep(statuses, comments), nil
+	}
+
+	var held map[string]bool
+	complete := false
+	if anyTop {
+		var err error
+		if held, complete, err = c.heldThreads(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// Whatever else still exists is held or rejected
+	for ids := range slices.Chunk(rest, lookupBatch) {
+		resp, err := c.service.Comments.List([]string{"id"}).
+			Id(ids...).
+			Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("API error (ModerationStatuses): %w", err)
+		}
+		for _, item := range resp.Items {
+			switch {
+			case reply[item.Id]:
+				statuses[item.Id] = ""
+			case held[item.Id]:
+				statuses[item.Id] = "heldForReview"
+			case complete:
+				statuses[item.Id] = "rejected"
+			default:
+				statuses[item.Id] = ""
+			}
+		}
+	}
+	return keep(statuses, comments), nil
+}
+
+// heldThreads returns the IDs of the held threads of the channel, and
+// whether that is all of them or only the first maxHeldPages pages
+func (c *Client) heldThreads(ctx context.Context) (map[string]bool, bool, error) {
+	held := make(map[string]bool)
+	call := c.service.CommentThreads.List([]string{"id"}).
+		AllThreadsRelatedToChannelId(c.channelID).
+		ModerationStatus("heldForReview").
+		MaxResults(100)
+	for range maxHeldPages {
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, false, fmt.Errorf("API error (held comments): %w", err)
+		}
+		for _, item := range resp.Items {
+			held[item.Id] = true
+		}
+		if resp.NextPageToken == "" {
+			return held, true, nil
+		}
+		call = call.PageToken(resp.NextPageToken)
+	}
+	return held, false, nil
+}
+
+// keep returns the statuses of comments only, dropping those of the
+// other replies listed with them
+func keep(statuses map[string]string, comments []Comment) map[string]string {
+	kept := make(map[string]string, len(comments))
+	for _, cmt := range comments {
+		if status, ok := statuses[cmt.ID]; ok {
+			kept[cmt.ID] = status
+		}
+	}
+	return kept
+}
@@ -0,0 +1,74 @@
+package youtube
+
+import "time"
+
+// Gap is a run of threads a poll left for later polls, because more
+// were new than it could process: those older than From, back to To
+type Gap struct {
+	FromID        string    `json:"fromId"` // oldest thread processed above the gap
+	FromPublished time.Time `json:"fromPublished"`
+	ToID          string    `json:"toId"` // newest thread processed below it
+	ToPublished   time.Time `json:"toPublished,omitzero"`
+}
+
+// Scan picks the threads a poll processes as it pages back from the
+// newest one: those newer than the last thread processed, then those of
+// the gaps earlier polls left, up to a limit. Threads are given to Next
+// newest first, and the gaps left once the scan is done are saved for
+// the next poll, see State.Gaps.
+type Scan struct {
+	gaps     []Gap // left to fill, newest first
+	skipping bool  // looking for the From thread of gaps[0]
+	limit    int
+	taken    int
+}
+
+// NewScan starts a poll's scan of the threads, which processes up to
+// limit of them
+func (s State) NewScan(limit int) *Scan {
+	gaps := append([]Gap{{ToID: s.LastID, ToPublished: s.LastPublished}}, s.Gaps...)
+	return &Scan{gaps: gaps, limit: limit}
+}
+
+// Next tells whether the next thread back, with the given ID and
+// publication time, is to be processed, and whether the scan is done
+func (sc *Scan) Next(id string, published time.Time) (take, done bool) {
+	for len(sc.gaps) > 0 {
+		g := &sc.gaps[0]
+		if sc.skipping {
+			if id == g.FromID {
+				sc.skipping = false
+				return false, false
+			}
+			if !published.Before(g.FromPublished) {
+				return false, false
+			}
+			// From was deleted, and this thread is older
+			sc.skipping = false
+		}
+		if id == g.ToID || published.Before(g.ToPublished) {
+			sc.gaps = sc.gaps[1:]
+			sc.skipping = true
+			continue
+		}
+		sc.taken++
+		g.FromID, g.FromPublished = id, published
+		return true, sc.Capped()
+	}
+	return false, true
+}
+
+// End records that no thread is left, so the gaps are filled
+func (sc *Scan) End() {
+	sc.gaps = nil
+}
+
+// Capped reports whether the scan stopped at its limit
+func (sc *Scan) Capped() bool {
+	return sc.taken >= sc.limit
+}
+
+// Gaps returns the gaps left for the next poll
+func (sc *Scan) Gaps() []Gap {
+	return sc.gaps
+}
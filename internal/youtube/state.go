@@ -3,17 +3,72 @@ package youtube
 import (
 	"encoding/json"
 	"os"
+	"time"
+)
+
+const (
+	// replyWatchAge is how long after it was posted a thread is watched
+	// for new replies
+	replyWatchAge = 7 * 24 * time.Hour
+	// maxWatchedThreads bounds the threads watched for new replies
+	maxWatchedThreads = 500
 )
 
 // State holds the processing state
 type State struct {
-	Mode   string `json:"mode"`   // "init" or "backfillDone"
-	LastID string `json:"lastId"` // last processed comment ID
+	Mode          string    `json:"mode"`                   // "init" or "backfillDone"
+	LastID        string    `json:"lastId"`                 // newest processed top-level comment ID
+	LastPublished time.Time `json:"lastPublished,omitzero"` // and when it was published
+
+	// Threads are the recent threads watched for new replies, by the ID
+	// of their top-level comment. Replies do not move LastID, so new
+	// replies to older threads are found through these.
+	Threads map[string]ThreadState `json:"threads,omitempty"`
+
+	// Gaps are the runs of threads older than LastID that polls left
+	// for later, newest first, see Scan
+	Gaps []Gap `json:"gaps,omitempty"`
+}
+
+// ThreadState is how far the replies of a watched thread were read
+type ThreadState struct {
+	Published time.Time `json:"published"`          // of the top-level comment
+	Replies   int64     `json:"replies"`            // reply count when last read
+	LastReply time.Time `json:"lastReply,omitzero"` // newest reply read
+}
+
+// watchable reports whether a thread is recent enough to be watched
+func (t ThreadState) watchable(now time.Time) bool {
+	return now.Sub(t.Published) <= replyWatchAge
 }
 
-// LoadState loads state.json from configs directory
+// Watch records how far the replies of a thread were read, so that
+// later polls look for new ones. Threads too old to watch are
+// forgotten, and so are the oldest ones beyond the 500 most recent.
+func (s *State) Watch(id string, t ThreadState, now time.Time) {
+	if s.Threads == nil {
+		s.Threads = make(map[string]ThreadState)
+	}
+	s.Threads[id] = t
+	for id, t := range s.Threads {
+		if !t.watchable(now) {
+			delete(s.Threads, id)
+		}
+	}
+	for len(s.Threads) > maxWatchedThreads {
+		oldest := ""
+		for id, t := range s.Threads {
+			if oldest == "" || t.Published.Before(s.Threads[oldest].Published) {
+				oldest = id
+			}
+		}
+		delete(s.Threads, oldest)
+	}
+}
+
+// LoadState loads the state file, see config.Config.StateFile
 func (c *Client) LoadState() State {
-	data, err := os.ReadFile("configs/state.json")
+	data, err := os.ReadFile(c.statePath)
 	if err != nil {
 		return State{Mode: "init", LastID: ""}
 	}
@@ -25,11 +80,21 @@ func (c *Client) LoadState() State {
 	return s
 }
 
-// SaveState saves state.json to configs directory
+// UpdateState changes the saved state with update. Concurrent updates
+// are applied one after the other.
+func (c *Client) UpdateState(update func(s *State)) error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	s := c.LoadState()
+	update(&s)
+	return c.SaveState(s)
+}
+
+// SaveState saves the state file
 func (c *Client) SaveState(s State) error {
 	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("configs/state.json", data, 0644)
+	return os.WriteFile(c.statePath, data, 0644)
 }
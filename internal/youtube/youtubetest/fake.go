@@ -0,0 +1,547 @@
+// Package youtubetest provides an in-memory stand-in for a YouTube
+// channel, to test the code that moderates it without the API.
+package youtubetest
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+)
+
+// The API methods whose calls the fake counts and can fail, see Fail
+const (
+	ThreadsList         = "commentThreads.list"
+	CommentsList        = "comments.list"
+	SetModerationStatus = "comments.setModerationStatus"
+	SubscriptionsList   = "subscriptions.list"
+)
+
+const (
+	// defaultPageSize is the number of threads per page of the backfill,
+	// as requested by youtube.Client
+	defaultPageSize = 100
+	// inlineReplies is how many replies the API lists with their thread.
+	// Threads with more have them fetched separately.
+	inlineReplies = 5
+	// lookupBatch is the number of threads youtube.Client looks up by ID
+	// per call
+	lookupBatch = 50
+)
+
+// APIError is an error response of the API. Errors given to Fail that
+// are not APIErrors are served as 500 Internal Server Error.
+type APIError struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+var (
+	// ErrQuotaExceeded is the error of a call once the daily quota of
+	// the API is used up
+	ErrQuotaExceeded = &APIError{
+		Code:    http.StatusForbidden,
+		Reason:  "quotaExceeded",
+		Message: "The request cannot be completed because you have exceeded your quota.",
+	}
+	// ErrBackend is the error of a call the API failed to serve
+	ErrBackend = &APIError{
+		Code:    http.StatusServiceUnavailable,
+		Reason:  "backendError",
+		Message: "Backend Error",
+	}
+)
+
+// Moderation is a call to SetModerationStatus
+type Moderation struct {
+	IDs       []string
+	Status    string
+	BanAuthor bool
+}
+
+// Fake is an in-memory YouTube channel. It has the methods of
+// youtube.Client the poller uses and behaves like them: comments are
+// fetched newest first, in pages, and sent to the Comments channel,
+// each thread's replies following it. Only published comments are
+// fetched, as the API lists no others. Recent threads are watched for
+// new replies, as youtube.State describes. Every page or lookup counts
+// as a call to the API method it would use, which can be made to fail.
+// It is safe for concurrent use.
+type Fake struct {
+	// PageSize is the number of threads per page of FetchAllComments,
+	// 100 if zero
+	PageSize int
+
+	out chan youtube.Comment
+
+	mu          sync.Mutex
+	threads     []*thread // newest first
+	comments    map[string]*youtube.Comment
+	subscribers map[string]bool
+	state       youtube.State
+	errs        map[string][]error
+	calls       map[string]int
+	moderations []Moderation
+}
+
+// thread is a top-level comment and its replies, oldest first
+type thread struct {
+	id      string
+	replies []string
+}
+
+// New creates a channel without comments, in its first run state
+func New() *Fake {
+	return &Fake{
+		out:         make(chan youtube.Comment, 150),
+		comments:    make(map[string]*youtube.Comment),
+		subscribers: make(map[string]bool),
+		state:       youtube.State{Mode: "init"},
+		errs:        make(map[string][]error),
+		calls:       make(map[string]int),
+	}
+}
+
+// Add posts comments, oldest first. A comment with a ParentID is a reply
+// to that thread, which must exist. Comments are published unless their
+// ModerationStatus says otherwise.
+func (f *Fake) Add(comments ...youtube.Comment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range comments {
+		if c.ModerationStatus == "" {
+			c.ModerationStatus = "published"
+		}
+		if c.ParentID == "" {
+			f.threads = slices.Insert(f.threads, 0, &thread{id: c.ID})
+		} else {
+			i := slices.IndexFunc(f.threads, func(t *thread) bool { return t.id == c.ParentID })
+			if i < 0 {
+				panic(fmt.Sprintf("youtubetest: reply %s to unknown thread %s", c.ID, c.ParentID))
+			}
+			f.threads[i].replies = append(f.threads[i].replies, c.ID)
+		}
+		f.comments[c.ID] = &c
+	}
+}
+
+// Delete removes a comment, as its author or a moderator would
+func (f *Fake) Delete(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.comments, id)
+}
+
+// Review sets the moderation status of a comment, as a moderator
+// reviewing it in YouTube Studio would
+func (f *Fake) Review(id, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.comments[id]; ok {
+		c.ModerationStatus = status
+	}
+}
+
+// Status returns the moderation status of a comment, "" if it does not
+// exist
+func (f *Fake) Status(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.comments[id]; ok {
+		return c.ModerationStatus
+	}
+	return ""
+}
+
+// Subscribe makes a channel a subscriber of ours
+func (f *Fake) Subscribe(channelID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribers[channelID] = true
+}
+
+// Fail makes the next calls to an API method return errs, one per call.
+// A nil error lets its call succeed, to fail a later one.
+func (f *Fake) Fail(method string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = append(f.errs[method], errs...)
+}
+
+// Calls returns how many times an API method was called
+func (f *Fake) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// Moderations returns the calls to SetModerationStatus that succeeded,
+// in order
+func (f *Fake) Moderations() []Moderation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.moderations)
+}
+
+// call counts a call to an API method and returns the error it was made
+// to fail with, if any. f.mu must be held.
+func (f *Fake) call(method string) error {
+	f.calls[method]++
+	if errs := f.errs[method]; len(errs) > 0 {
+		f.errs[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// Comments returns the channel the fetched comments are sent to
+func (f *Fake) Comments() <-chan youtube.Comment {
+	return f.out
+}
+
+// FetchAllComments sends every comment, page by page
+func (f *Fake) FetchAllComments(ctx context.Context) error {
+	size := f.PageSize
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	for start := 0; ; start += size {
+		page, more, err := f.page(start, size, false)
+		if err != nil {
+			return fmt.Errorf("API error (FetchAllComments): %w", err)
+		}
+		if err := f.send(ctx, page); err != nil {
+			return err
+		}
+		f.watch(threadsOf(page))
+		if !more {
+			return nil
+		}
+	}
+}
+
+// FetchLatestComments sends the comments of the threads about the
+// channel itself newer than the last one of the state, then those of
+// the gaps of the state, oldest thread first, up to limit threads, see
+// youtube.Scan. The new replies to the watched threads follow.
+func (f *Fake) FetchLatestComments(ctx context.Context, limit int64) error {
+	size := f.PageSize
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	scan := f.LoadState().NewScan(int(limit))
+
+	var threads [][]youtube.Comment
+	for start, done := 0, false; !done; start += size {
+		page, more, err := f.page(start, size, true)
+		if err != nil {
+			return fmt.Errorf("API error (FetchLatestComments): %w", err)
+		}
+		take := false
+		for _, c := range page {
+			if c.ParentID != "" {
+				if take {
+					threads[len(threads)-1] = append(threads[len(threads)-1], c)
+				}
+				continue
+			}
+			if done {
+				break
+			}
+			if take, done = scan.Next(c.ID, c.PublishedAt); take {
+				threads = append(threads, []youtube.Comment{c})
+			}
+		}
+		if !done && !more {
+			scan.End()
+			done = true
+		}
+	}
+	f.UpdateState(func(s *youtube.State) { s.Gaps = scan.Gaps() })
+
+	read := make(map[string]bool)
+	for i := len(threads) - 1; i >= 0; i-- {
+		if err := f.send(ctx, threads[i]); err != nil {
+			return err
+		}
+		read[threads[i][0].ID] = true
+	}
+	f.watch(threads)
+
+	return f.fetchNewReplies(ctx, read)
+}
+
+// fetchNewReplies sends the replies posted to the watched threads, other
+// than those just read, since they were last read. Every 50 threads
+// count as a commentThreads.list call, and every thread whose reply
+// count changed as a comments.list call.
+func (f *Fake) fetchNewReplies(ctx context.Context, read map[string]bool) error {
+	watched := f.LoadState().Threads
+	var ids []string
+	for id := range watched {
+		if !read[id] {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	for batch := range slices.Chunk(ids, lookupBatch) {
+		found, replies, err := f.lookup(batch, watched)
+		if err != nil {
+			return fmt.Errorf("API error (new replies): %w", err)
+		}
+		if err := f.send(ctx, replies); err != nil {
+			return err
+		}
+		now := time.Now()
+		f.UpdateState(func(s *youtube.State) {
+			for _, id := range batch {
+				if t, ok := found[id]; ok {
+					s.Watch(id, t, now)
+				} else {
+					delete(s.Threads, id)
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// lookup returns how far the published threads of ids are read once
+// their replies newer than in watched are, and those replies
+func (f *Fake) lookup(ids []string, watched map[string]youtube.ThreadState) (map[string]youtube.ThreadState, []youtube.Comment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(ThreadsList); err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]youtube.ThreadState)
+	var replies []youtube.Comment
+	for _, t := range f.threads {
+		c, ok := f.comments[t.id]
+		if !ok || c.ModerationStatus != "published" || !slices.Contains(ids, t.id) {
+			continue
+		}
+		ts := watched[t.id]
+		if cur := f.replies(t); int64(len(cur)) != ts.Replies {
+			if err := f.call(CommentsList); err != nil {
+				return nil, nil, fmt.Errorf("replies of %s: %w", t.id, err)
+			}
+			ts.Replies = int64(len(cur))
+			for _, r := range cur {
+				if r.PublishedAt.After(ts.LastReply) {
+					replies = append(replies, *r)
+					ts.LastReply = r.PublishedAt
+				}
+			}
+		}
+		found[t.id] = ts
+	}
+	return found, replies, nil
+}
+
+// watch records how far threads were read, each a top-level comment
+// followed by its replies
+func (f *Fake) watch(threads [][]youtube.Comment) {
+	now := time.Now()
+	f.UpdateState(func(s *youtube.State) {
+		for _, t := range threads {
+			ts := youtube.ThreadState{Published: t[0].PublishedAt, Replies: int64(len(t) - 1)}
+			for _, r := range t[1:] {
+				if r.PublishedAt.After(ts.LastReply) {
+					ts.LastReply = r.PublishedAt
+				}
+			}
+			s.Watch(t[0].ID, ts, now)
+		}
+	})
+}
+
+// threadsOf splits a page of comments into its threads
+func threadsOf(page []youtube.Comment) [][]youtube.Comment {
+	var threads [][]youtube.Comment
+	for _, c := range page {
+		if c.ParentID != "" {
+			threads[len(threads)-1] = append(threads[len(threads)-1], c)
+		} else {
+			threads = append(threads, []youtube.Comment{c})
+		}
+	}
+	return threads
+}
+
+// page returns the comments of size published threads from start, with
+// their published replies, and whether more threads follow. With
+// channelOnly, only the threads about the channel itself count.
+func (f *Fake) page(start, size int, channelOnly bool) ([]youtube.Comment, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(ThreadsList); err != nil {
+		return nil, false, err
+	}
+
+	var page []youtube.Comment
+	threads, more := f.threadPage(start, size, channelOnly, "published")
+	for _, t := range threads {
+		page = append(page, *f.comments[t.id])
+		replies := f.replies(t)
+		if len(replies) > inlineReplies {
+			if err := f.call(CommentsList); err != nil {
+				return nil, false, fmt.Errorf("replies of %s: %w", t.id, err)
+			}
+		}
+		for _, r := range replies {
+			page = append(page, *r)
+		}
+	}
+	return page, more, nil
+}
+
+// threadPage returns the threads whose top-level comment has the given
+// moderation status from start, newest first, up to size of them, and
+// whether more follow. With channelOnly, only the threads about the
+// channel itself count, not those under its videos. Threads whose
+// top-level comment was deleted are left out. f.mu must be held.
+func (f *Fake) threadPage(start, size int, channelOnly bool, status string) ([]*thread, bool) {
+	var threads []*thread
+	for _, t := range f.threads {
+		c, ok := f.comments[t.id]
+		if ok && (!channelOnly || c.VideoID == "") && c.ModerationStatus == status {
+			threads = append(threads, t)
+		}
+	}
+	start = min(start, len(threads))
+	end := min(start+size, len(threads))
+	return threads[start:end], end < len(threads)
+}
+
+// replies returns the published replies of a thread. f.mu must be held.
+func (f *Fake) replies(t *thread) []*youtube.Comment {
+	var replies []*youtube.Comment
+	for _, id := range t.replies {
+		if r, ok := f.comments[id]; ok && r.ModerationStatus == "published" {
+			replies = append(replies, r)
+		}
+	}
+	return replies
+}
+
+// send sends comments to the Comments channel
+func (f *Fake) send(ctx context.Context, comments []youtube.Comment) error {
+	for _, c := range comments {
+		select {
+		case f.out <- c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// LoadState returns the state last saved
+func (f *Fake) LoadState() youtube.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.state
+	s.Threads = maps.Clone(s.Threads)
+	return s
+}
+
+// UpdateState changes the saved state with update
+func (f *Fake) UpdateState(update func(s *youtube.State)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	update(&f.state)
+	return nil
+}
+
+// SaveState saves the state
+func (f *Fake) SaveState(s youtube.State) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = s
+	f.state.Threads = maps.Clone(s.Threads)
+	return nil
+}
+
+// SetModerationStatus sets the moderation status of comments and
+// records the call
+func (f *Fake) SetModerationStatus(_ context.Context, commentIDs []string, moderationStatus string, banAuthor bool) error {
+	if len(commentIDs) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(SetModerationStatus); err != nil {
+		return fmt.Errorf("failed to hide comments %v: %w", commentIDs, err)
+	}
+	f.moderate(commentIDs, moderationStatus, banAuthor)
+	return nil
+}
+
+// moderate sets the moderation status of comments and records it. f.mu
+// must be held.
+func (f *Fake) moderate(commentIDs []string, moderationStatus string, banAuthor bool) {
+	for _, id := range commentIDs {
+		if c, ok := f.comments[id]; ok {
+			c.ModerationStatus = moderationStatus
+		}
+	}
+	f.moderations = append(f.moderations, Moderation{
+		IDs:       slices.Clone(commentIDs),
+		Status:    moderationStatus,
+		BanAuthor: banAuthor,
+	})
+}
+
+// ModerationStatuses tells how moderators reviewed comments, with what
+// youtube.Client can tell from the listings of the API: "published",
+// "heldForReview" or "rejected" for top-level comments, and "published"
+// or "" for replies, whose other statuses cannot be told apart. Comments
+// that no longer exist are left out. It counts as one
+// commentThreads.list call.
+func (f *Fake) ModerationStatuses(_ context.Context, comments []youtube.Comment) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(ThreadsList); err != nil {
+		return nil, fmt.Errorf("API error (ModerationStatuses): %w", err)
+	}
+	statuses := make(map[string]string)
+	for _, c := range comments {
+		cur, ok := f.comments[c.ID]
+		switch {
+		case !ok:
+		case cur.ModerationStatus == "published":
+			statuses[c.ID] = "published"
+		case c.ParentID != "":
+			statuses[c.ID] = ""
+		case cur.ModerationStatus == "heldForReview":
+			statuses[c.ID] = "heldForReview"
+		default:
+			statuses[c.ID] = "rejected"
+		}
+	}
+	return statuses, nil
+}
+
+// IsSubscriber reports whether a channel was made a subscriber with
+// Subscribe
+func (f *Fake) IsSubscriber(_ context.Context, channelID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(SubscriptionsList); err != nil {
+		return false, fmt.Errorf("API error (IsSubscriber): %w", err)
+	}
+	return f.subscribers[channelID], nil
+}
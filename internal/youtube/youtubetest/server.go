@@ -0,0 +1,316 @@
+package youtubetest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joshkleinlab/tubeguardian/internal/youtube"
+	api "google.golang.org/api/youtube/v3"
+)
+
+const (
+	// defaultMaxResults and maxMaxResults bound the items per page of a
+	// list call, as the API does
+	defaultMaxResults = 20
+	maxMaxResults     = 100
+)
+
+// Server serves the comments of a Fake over HTTP as the YouTube Data
+// API does: commentThreads.list, comments.list,
+// comments.setModerationStatus and subscriptions.list, close enough for
+// youtube.Client to run against it unchanged (see config.APIEndpoint).
+// Lists are paged with page tokens, and errors given to Fake.Fail are
+// served as API error responses. Like the API, thread and reply
+// listings only return published comments unless commentThreads.list
+// asks for another moderationStatus, and comments looked up by ID come
+// without their moderation status. Requests are not authenticated.
+type Server struct {
+	*httptest.Server
+	Fake *Fake
+}
+
+// NewServer starts serving f. Close the server when done.
+func NewServer(f *Fake) *Server {
+	s := &Server{Fake: f}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /youtube/v3/commentThreads", s.commentThreads)
+	mux.HandleFunc("GET /youtube/v3/comments", s.comments)
+	mux.HandleFunc("POST /youtube/v3/comments/setModerationStatus", s.setModerationStatus)
+	mux.HandleFunc("GET /youtube/v3/subscriptions", s.subscriptions)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// commentThreads serves commentThreads.list, for threads by ID, all the
+// threads of the channel (allThreadsRelatedToChannelId) or those about
+// the channel itself (channelId). Threads come newest first, with up to
+// 5 replies, and only published ones unless moderationStatus asks for
+// held or likely spam threads instead.
+func (s *Server) commentThreads(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ids := values(q, "id")
+	channelOnly := q.Get("channelId") != ""
+	if len(ids) == 0 && !channelOnly && q.Get("allThreadsRelatedToChannelId") == "" {
+		writeError(w, &APIError{Code: http.StatusBadRequest, Reason: "missingRequiredParameter", Message: "No filter selected."})
+		return
+	}
+	status := "published"
+	if v := q.Get("moderationStatus"); v != "" {
+		if len(ids) > 0 || (v != "published" && v != "heldForReview" && v != "likelySpam") {
+			writeError(w, &APIError{Code: http.StatusBadRequest, Reason: "invalidModerationStatus", Message: "Invalid moderation status."})
+			return
+		}
+		status = v
+	}
+	start, size, err := paging(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	f := s.Fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(ThreadsList); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var threads []*thread
+	more := false
+	if len(ids) > 0 {
+		for _, t := range f.threads {
+			if c, ok := f.comments[t.id]; ok && c.ModerationStatus == status && slices.Contains(ids, t.id) {
+				threads = append(threads, t)
+			}
+		}
+	} else {
+		threads, more = f.threadPage(start, size, channelOnly, status)
+	}
+	resp := &api.CommentThreadListResponse{Kind: "youtube#commentThreadListResponse"}
+	for _, t := range threads {
+		top := f.comments[t.id]
+		replies := f.replies(t)
+		item := &api.CommentThread{
+			Kind: "youtube#commentThread",
+			Id:   t.id,
+			Snippet: &api.CommentThreadSnippet{
+				VideoId:         top.VideoID,
+				TopLevelComment: apiComment(top, len(ids) == 0),
+				TotalReplyCount: int64(len(replies)),
+			},
+		}
+		if len(replies) > 0 && slices.Contains(values(q, "part"), "replies") {
+			item.Replies = &api.CommentThreadReplies{}
+			for _, r := range replies[:min(len(replies), inlineReplies)] {
+				item.Replies.Comments = append(item.Replies.Comments, apiComment(r, len(ids) == 0))
+			}
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	if more {
+		resp.NextPageToken = strconv.Itoa(start + size)
+	}
+	writeJSON(w, resp)
+}
+
+// comments serves comments.list, for comments by ID or the published
+// replies to a comment (parentId), oldest first
+func (s *Server) comments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ids := values(q, "id")
+	parentID := q.Get("parentId")
+	if len(ids) == 0 && parentID == "" {
+		writeError(w, &APIError{Code: http.StatusBadRequest, Reason: "missingRequiredParameter", Message: "No filter selected."})
+		return
+	}
+	start, size, err := paging(q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	f := s.Fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(CommentsList); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := &api.CommentListResponse{Kind: "youtube#commentListResponse"}
+	if len(ids) > 0 {
+		for _, id := range ids {
+			if c, ok := f.comments[id]; ok {
+				resp.Items = append(resp.Items, apiComment(c, false))
+			}
+		}
+		writeJSON(w, resp)
+		return
+	}
+
+	var replies []*youtube.Comment
+	for _, t := range f.threads {
+		if t.id == parentID {
+			replies = f.replies(t)
+		}
+	}
+	start = min(start, len(replies))
+	end := min(start+size, len(replies))
+	for _, c := range replies[start:end] {
+		resp.Items = append(resp.Items, apiComment(c, true))
+	}
+	if end < len(replies) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	writeJSON(w, resp)
+}
+
+// setModerationStatus serves comments.setModerationStatus
+func (s *Server) setModerationStatus(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ids := values(q, "id")
+	status := q.Get("moderationStatus")
+	switch {
+	case len(ids) == 0:
+		writeError(w, &APIError{Code: http.StatusBadRequest, Reason: "missingRequiredParameter", Message: "No id given."})
+		return
+	case status != "heldForReview" && status != "published" && status != "rejected":
+		writeError(w, &APIError{Code: http.StatusBadRequest, Reason: "invalidModerationStatus", Message: "Invalid moderation status."})
+		return
+	}
+	ban := q.Get("banAuthor") == "true"
+	if ban && status != "rejected" {
+		writeError(w, &APIError{Code: http.StatusBadRequest, Reason: "banWithoutReject", Message: "banAuthor requires rejected."})
+		return
+	}
+
+	f := s.Fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(SetModerationStatus); err != nil {
+		writeError(w, err)
+		return
+	}
+	f.moderate(ids, status, ban)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subscriptions serves subscriptions.list for a subscriber (channelId)
+// of our channel (forChannelId)
+func (s *Server) subscriptions(w http.ResponseWriter, r *http.Request) {
+	channelID := r.URL.Query().Get("channelId")
+
+	f := s.Fake
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call(SubscriptionsList); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := &api.SubscriptionListResponse{Kind: "youtube#subscriptionListResponse"}
+	if f.subscribers[channelID] {
+		resp.Items = append(resp.Items, &api.Subscription{Kind: "youtube#subscription", Id: "sub-" + channelID})
+	}
+	writeJSON(w, resp)
+}
+
+// values returns the values of a list parameter, which may be repeated
+// or separated by commas
+func values(q url.Values, key string) []string {
+	var values []string
+	for _, v := range q[key] {
+		values = append(values, strings.Split(v, ",")...)
+	}
+	return values
+}
+
+// paging returns the offset a list request starts from, given its page
+// token, and how many items it asks for
+func paging(q url.Values) (start, size int, err error) {
+	size = defaultMaxResults
+	if v := q.Get("maxResults"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > maxMaxResults {
+			return 0, 0, &APIError{Code: http.StatusBadRequest, Reason: "invalidValue", Message: "Invalid maxResults."}
+		}
+	}
+	if v := q.Get("pageToken"); v != "" {
+		if start, err = strconv.Atoi(v); err != nil || start < 0 {
+			return 0, 0, &APIError{Code: http.StatusBadRequest, Reason: "invalidPageToken", Message: "Invalid page token."}
+		}
+	}
+	return start, size, nil
+}
+
+// apiComment converts a comment to its API form, with its moderation
+// status if withStatus: the API leaves it out of lookups by ID
+func apiComment(c *youtube.Comment, withStatus bool) *api.Comment {
+	s := &api.CommentSnippet{
+		TextDisplay:       c.Text,
+		TextOriginal:      c.TextOriginal,
+		AuthorDisplayName: c.AuthorDisplayName,
+		VideoId:           c.VideoID,
+		ParentId:          c.ParentID,
+		PublishedAt:       formatTime(c.PublishedAt),
+		UpdatedAt:         formatTime(c.UpdatedAt),
+		LikeCount:         c.LikeCount,
+	}
+	if withStatus {
+		s.ModerationStatus = c.ModerationStatus
+	}
+	if c.AuthorChannelID != "" {
+		s.AuthorChannelId = &api.CommentSnippetAuthorChannelId{Value: c.AuthorChannelID}
+	}
+	return &api.Comment{Kind: "youtube#comment", Id: c.ID, Snippet: s}
+}
+
+// formatTime formats an API timestamp, "" for the zero time
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// writeJSON writes a successful response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the error response of err, which is an APIError or
+// served as a 500
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = &APIError{Code: http.StatusInternalServerError, Reason: "internalError", Message: err.Error()}
+	}
+
+	type errorItem struct {
+		Message string `json:"message"`
+		Domain  string `json:"domain"`
+		Reason  string `json:"reason"`
+	}
+	var body struct {
+		Error struct {
+			Code    int         `json:"code"`
+			Message string      `json:"message"`
+			Errors  []errorItem `json:"errors"`
+		} `json:"error"`
+	}
+	body.Error.Code = apiErr.Code
+	body.Error.Message = apiErr.Message
+	body.Error.Errors = []errorItem{{Message: apiErr.Message, Domain: "youtube", Reason: apiErr.Reason}}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(apiErr.Code)
+	json.NewEncoder(w).Encode(body)
+}